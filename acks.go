@@ -0,0 +1,316 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//ackTracker keeps deliveries of a client ack subscription which are not acknowledged yet, in delivery order
+type ackTracker struct {
+	mutex   sync.Mutex
+	entries []*ackEntry
+	//processed counts messages marked by Client.Ack since the last cumulative ACK
+	processed int
+	stop      chan struct{}
+}
+
+type ackEntry struct {
+	ackId     string
+	messageId string
+	processed bool
+	//joined are ack ids of messages processed together with this one, e.g. chunks of a reassembled message
+	joined []string
+	//settled are called with true when the message is acknowledged, with false when it is not anymore
+	settled []func(acked bool)
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{stop: make(chan struct{})}
+}
+
+func (tracker *ackTracker) delivered(ackId, messageId string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.entries = append(tracker.entries, &ackEntry{ackId: ackId, messageId: messageId})
+}
+
+//markProcessed mark the message and the messages joined to it.
+//It returns the number of messages processed since the last cumulative ACK.
+func (tracker *ackTracker) markProcessed(ackId string) int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	marked := map[string]bool{ackId: true}
+	for _, entry := range tracker.entries {
+		if entry.ackId == ackId {
+			for _, joined := range entry.joined {
+				marked[joined] = true
+			}
+			break
+		}
+	}
+	for _, entry := range tracker.entries {
+		if marked[entry.ackId] && !entry.processed {
+			entry.processed = true
+			tracker.processed++
+		}
+	}
+	return tracker.processed
+}
+
+//join make markProcessed of ackId mark the joined messages as well
+func (tracker *ackTracker) join(ackId string, joined []string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, entry := range tracker.entries {
+		if entry.ackId == ackId {
+			entry.joined = append(entry.joined, joined...)
+			return
+		}
+	}
+}
+
+//checkpoint returns ack id of the last message of the longest processed prefix.
+//Acknowledging it with cumulative ACK never acknowledges a message which is still being processed.
+func (tracker *ackTracker) checkpoint() (string, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	last := -1
+	for i, entry := range tracker.entries {
+		if !entry.processed {
+			break
+		}
+		last = i
+	}
+	if last < 0 {
+		return "", false
+	}
+	return tracker.entries[last].ackId, true
+}
+
+//onSettled register fn to be called when the message is acknowledged or forgotten.
+//It returns false if the message is not tracked.
+func (tracker *ackTracker) onSettled(ackId string, fn func(acked bool)) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for _, entry := range tracker.entries {
+		if entry.ackId == ackId {
+			entry.settled = append(entry.settled, fn)
+			return true
+		}
+	}
+	return false
+}
+
+//removeUpTo forget the message and all delivered before it, as cumulative ACK or NACK does.
+//It returns the forgotten entries.
+func (tracker *ackTracker) removeUpTo(ackId string) []*ackEntry {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for i, entry := range tracker.entries {
+		if entry.ackId == ackId {
+			removed := tracker.entries[:i+1]
+			for _, entry := range removed {
+				if entry.processed {
+					tracker.processed--
+				}
+			}
+			tracker.entries = tracker.entries[i+1:]
+			return removed
+		}
+	}
+	return nil
+}
+
+func (tracker *ackTracker) remove(ackId string) []*ackEntry {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for i, entry := range tracker.entries {
+		if entry.ackId == ackId {
+			if entry.processed {
+				tracker.processed--
+			}
+			tracker.entries = append(tracker.entries[:i], tracker.entries[i+1:]...)
+			return []*ackEntry{entry}
+		}
+	}
+	return nil
+}
+
+//entriesUpTo returns ack ids of the message and all delivered before it
+func (tracker *ackTracker) entriesUpTo(ackId string) []string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	ids := make([]string, 0)
+	for _, entry := range tracker.entries {
+		ids = append(ids, entry.ackId)
+		if entry.ackId == ackId {
+			return ids
+		}
+	}
+	return nil
+}
+
+//lastDelivered returns the index of the ack id which was delivered last, -1 if none of them is tracked
+func (tracker *ackTracker) lastDelivered(ackIds []string) int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	for i := len(tracker.entries) - 1; i >= 0; i-- {
+		for index, ackId := range ackIds {
+			if tracker.entries[i].ackId == ackId {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+//reset forget all deliveries, ack ids are not valid after reconnect.
+//It returns the forgotten entries.
+func (tracker *ackTracker) reset() []*ackEntry {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	removed := tracker.entries
+	tracker.entries = nil
+	tracker.processed = 0
+	return removed
+}
+
+//settle call functions registered by onSettled of removed entries, outside of the tracker lock
+func settle(removed []*ackEntry, acked bool) {
+	for _, entry := range removed {
+		for _, fn := range entry.settled {
+			fn(acked)
+		}
+	}
+}
+
+func (tracker *ackTracker) unacked() []string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	ids := make([]string, 0, len(tracker.entries))
+	for _, entry := range tracker.entries {
+		ids = append(ids, entry.messageId)
+	}
+	return ids
+}
+
+//Unacked returns ids of messages delivered to the subscription and not acknowledged yet, in delivery order.
+//Tracking is done for ACK_CLIENT and ACK_CLIENT_INDIVIDUAL subscriptions only.
+func (subs *Subscription) Unacked() []string {
+	if subs.tracker == nil {
+		return nil
+	}
+	return subs.tracker.unacked()
+}
+
+//batchAcks reports whether Client.Ack only marks messages as processed and ACK is sent in batches
+func (subs *Subscription) batchAcks() bool {
+	return subs.tracker != nil && subs.Ack == ACK_CLIENT && (subs.AckBatchSize > 0 || subs.AckBatchInterval > 0)
+}
+
+//AckUpTo acknowledge the message and all messages delivered to its subscription before it.
+//For ACK_CLIENT a single cumulative ACK is sent, for ACK_CLIENT_INDIVIDUAL every tracked message is acknowledged.
+func (client *Client) AckUpTo(msg *message.Message) error {
+	ackId, err := msg.GetHeader(message.Ack)
+	if err != nil {
+		return err
+	}
+
+	subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+	if subscription == nil || subscription.tracker == nil {
+		return errors.New("message does not belong to a client ack subscription")
+	}
+
+	if subscription.Ack == ACK_CLIENT_INDIVIDUAL {
+		ids := subscription.tracker.entriesUpTo(ackId)
+		if ids == nil {
+			ids = []string{ackId}
+		}
+		for _, id := range ids {
+			err = client.sendAck(frame.ACK, id, subscription)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return client.sendAck(frame.ACK, ackId, subscription)
+}
+
+//FlushAcks send cumulative ACK for all messages of the subscription processed so far
+func (client *Client) FlushAcks(subscription *Subscription) error {
+	if subscription.tracker == nil {
+		return nil
+	}
+
+	ackId, ok := subscription.tracker.checkpoint()
+	if !ok {
+		return nil
+	}
+	return client.sendAck(frame.ACK, ackId, subscription)
+}
+
+//sendAck send ACK or NACK frame and update tracking of the subscription
+func (client *Client) sendAck(command, ackId string, subscription *Subscription) error {
+	frm := frame.NewFrame(command, []byte(""))
+	frm.Headers[message.Id] = ackId
+
+	err := client.sender(frm)
+	if err != nil {
+		return err
+	}
+
+	if subscription == nil {
+		return nil
+	}
+	if command == frame.ACK {
+		client.metrics.Acked(subscription.Destination, subscription.metricsName())
+	} else {
+		client.metrics.Nacked(subscription.Destination, subscription.metricsName())
+	}
+
+	if subscription.tracker != nil {
+		var removed []*ackEntry
+		if subscription.Ack == ACK_CLIENT {
+			removed = subscription.tracker.removeUpTo(ackId)
+		} else {
+			removed = subscription.tracker.remove(ackId)
+		}
+		settle(removed, command == frame.ACK)
+		client.releaseWindow(subscription, len(removed))
+	}
+	return nil
+}
+
+//flushAcksLoop send cumulative ACK of processed messages every AckBatchInterval
+func (client *Client) flushAcksLoop(subscription *Subscription) {
+	ticker := time.NewTicker(subscription.AckBatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-subscription.tracker.stop:
+			return
+		case <-ticker.C:
+			err := client.FlushAcks(subscription)
+			if err != nil {
+				client.logger.Error("cannot send batched ACK", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+			}
+		}
+	}
+}
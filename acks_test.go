@@ -0,0 +1,201 @@
+package gostomp
+
+import (
+	"bytes"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//recordingConn keeps everything written by the client
+type recordingConn struct {
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (conn *recordingConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (conn *recordingConn) Write(p []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.written.Write(p)
+}
+
+func (conn *recordingConn) Close() error {
+	return nil
+}
+
+//frames returns command and id header of every written frame, e.g. "ACK 3"
+func (conn *recordingConn) frames() []string {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	frames := make([]string, 0)
+	for _, raw := range strings.Split(conn.written.String(), "\x00") {
+		lines := strings.Split(strings.TrimLeft(raw, "\n"), "\n")
+		if len(lines) == 0 || lines[0] == "" {
+			continue
+		}
+		id := ""
+		for _, line := range lines[1:] {
+			if strings.HasPrefix(line, "id:") {
+				id = strings.TrimPrefix(line, "id:")
+			}
+		}
+		frames = append(frames, lines[0]+" "+id)
+	}
+	return frames
+}
+
+//newConnectedClient returns a client which writes frames to conn without a broker
+func newConnectedClient(t *testing.T, conn *recordingConn) *Client {
+	t.Helper()
+
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.setConn(conn)
+	client.setState(StateConnected)
+	return client
+}
+
+func newTrackedSubscription(client *Client, ack string, ackIds ...string) *Subscription {
+	subscription := &Subscription{id: "sub-1", Ack: ack, Destination: "/queue/orders", tracker: newAckTracker()}
+	client.addSubscriptions(subscription)
+	for _, ackId := range ackIds {
+		subscription.tracker.delivered(ackId, "m"+ackId)
+	}
+	return subscription
+}
+
+func newDelivery(ackId string) *message.Message {
+	msg := message.New(nil)
+	msg.SetID("m" + ackId)
+	msg.SetHeader(message.Ack, ackId)
+	msg.SetHeader(message.Subscription, "sub-1")
+	return msg
+}
+
+func TestAckTrackerCheckpointWaitsForUnprocessedPrefix(t *testing.T) {
+	tracker := newAckTracker()
+	for _, ackId := range []string{"1", "2", "3", "4"} {
+		tracker.delivered(ackId, "m"+ackId)
+	}
+
+	tracker.markProcessed("2")
+	tracker.markProcessed("3")
+	if ackId, ok := tracker.checkpoint(); ok {
+		t.Fatalf("checkpoint %s acknowledges message 1 which is still being processed", ackId)
+	}
+
+	if processed := tracker.markProcessed("1"); processed != 3 {
+		t.Fatalf("expected 3 processed messages, got %d", processed)
+	}
+	ackId, ok := tracker.checkpoint()
+	if !ok || ackId != "3" {
+		t.Fatalf("expected checkpoint 3, got %q", ackId)
+	}
+
+	tracker.removeUpTo(ackId)
+	if unacked := tracker.unacked(); !reflect.DeepEqual(unacked, []string{"m4"}) {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+	if processed := tracker.markProcessed("4"); processed != 1 {
+		t.Fatalf("processed counter is not reduced by the cumulative ACK, got %d", processed)
+	}
+}
+
+func TestAckTrackerMarkProcessedTwice(t *testing.T) {
+	tracker := newAckTracker()
+	tracker.delivered("1", "m1")
+
+	tracker.markProcessed("1")
+	if processed := tracker.markProcessed("1"); processed != 1 {
+		t.Fatalf("message is counted twice, got %d", processed)
+	}
+	if processed := tracker.markProcessed("unknown"); processed != 1 {
+		t.Fatalf("unknown ack id is counted, got %d", processed)
+	}
+}
+
+func TestAckTrackerRemoveIndividual(t *testing.T) {
+	tracker := newAckTracker()
+	for _, ackId := range []string{"1", "2", "3"} {
+		tracker.delivered(ackId, "m"+ackId)
+	}
+	tracker.markProcessed("2")
+
+	tracker.remove("2")
+	if unacked := tracker.unacked(); !reflect.DeepEqual(unacked, []string{"m1", "m3"}) {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+	if _, ok := tracker.checkpoint(); ok {
+		t.Fatal("checkpoint without processed messages")
+	}
+	if ids := tracker.entriesUpTo("3"); !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Fatalf("unexpected entries %v", ids)
+	}
+	if ids := tracker.entriesUpTo("2"); ids != nil {
+		t.Fatalf("entries of a removed message %v", ids)
+	}
+}
+
+func TestFlushAcksSendsCumulativeAckOfProcessedPrefix(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	subscription := newTrackedSubscription(client, ACK_CLIENT, "1", "2", "3")
+	subscription.AckBatchSize = 10
+
+	client.Ack(newDelivery("1"))
+	client.Ack(newDelivery("3"))
+	if frames := conn.frames(); len(frames) != 0 {
+		t.Fatalf("batched Ack sent frames %v", frames)
+	}
+
+	err := client.FlushAcks(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"ACK 1"}) {
+		t.Fatalf("expected cumulative ACK of message 1, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); !reflect.DeepEqual(unacked, []string{"m2", "m3"}) {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+
+	client.Ack(newDelivery("2"))
+	err = client.FlushAcks(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"ACK 1", "ACK 3"}) {
+		t.Fatalf("expected cumulative ACK of message 3, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); len(unacked) != 0 {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+}
+
+func TestAckUpToClientIndividual(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	subscription := newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1", "2", "3")
+
+	err := client.AckUpTo(newDelivery("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"ACK 1", "ACK 2"}) {
+		t.Fatalf("expected ACK of every message up to 2, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); !reflect.DeepEqual(unacked, []string{"m3"}) {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+}
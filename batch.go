@@ -0,0 +1,253 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBatchSize  = 100
+	DefaultBatchDelay = 10 * time.Millisecond
+)
+
+//ErrBatchProducerClosed is the result of messages passed to a closed BatchProducer
+var ErrBatchProducerClosed = errors.New("batch producer is closed")
+
+//BatchConfig describes when batches are written and how they are confirmed
+type BatchConfig struct {
+	//MaxSize writes the batch when it holds this many messages, DefaultBatchSize if zero
+	MaxSize int
+	//MaxDelay writes a batch at most this long after its first message was queued, DefaultBatchDelay if zero
+	MaxDelay time.Duration
+	//Transaction wraps every batch in BEGIN and COMMIT, so the broker delivers all messages of the batch or none
+	Transaction bool
+	//Receipt requests a receipt for the last frame of every batch, results are reported after it arrives.
+	//Without it results only tell whether the batch was written to the socket.
+	Receipt bool
+}
+
+//BatchProducer queues messages and writes them as SEND frames with a single flush.
+//Messages are sent in the order of Producer calls.
+//Batches are not sent again on failure: WithRetry does not apply and the Artemis duplicate id is not set,
+//so a failed message may be sent again with Client.Producer, which retries it.
+type BatchProducer struct {
+	client *Client
+	config BatchConfig
+	mutex  sync.Mutex
+	queue  []*batchEntry
+	//flushMutex lets only one batch be written at a time, so batches keep their order
+	flushMutex sync.Mutex
+	wakeup     chan struct{}
+	closing    chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+type batchEntry struct {
+	msg    *message.Message
+	result chan error
+	span   Span
+}
+
+func (entry *batchEntry) finish(err error) {
+	if entry.span != nil {
+		if err != nil {
+			entry.span.RecordError(err)
+		}
+		entry.span.End()
+	}
+	entry.result <- err
+}
+
+func NewBatchProducer(client *Client, config BatchConfig) *BatchProducer {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultBatchSize
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultBatchDelay
+	}
+
+	producer := &BatchProducer{
+		client:  client,
+		config:  config,
+		wakeup:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go producer.flushLoop()
+	return producer
+}
+
+//Producer queue the message, the returned channel receives the result when its batch is sent.
+//A full batch is written by the caller which filled it.
+func (producer *BatchProducer) Producer(msg *message.Message) <-chan error {
+	if msg.GetID() == "" {
+		msg.SetID(uuid.New().String())
+	}
+	entry := &batchEntry{msg: msg, result: make(chan error, 1)}
+
+	producer.mutex.Lock()
+	select {
+	case <-producer.closing:
+		producer.mutex.Unlock()
+		entry.result <- ErrBatchProducerClosed
+		return entry.result
+	default:
+	}
+	producer.queue = append(producer.queue, entry)
+	size := len(producer.queue)
+	producer.mutex.Unlock()
+
+	if size >= producer.config.MaxSize {
+		producer.Flush()
+	} else if size == 1 {
+		select {
+		case producer.wakeup <- struct{}{}:
+		default:
+		}
+	}
+	return entry.result
+}
+
+//Flush send queued messages now, it returns the error of the whole batch if there is one
+func (producer *BatchProducer) Flush() error {
+	producer.flushMutex.Lock()
+	defer producer.flushMutex.Unlock()
+
+	producer.mutex.Lock()
+	entries := producer.queue
+	producer.queue = nil
+	producer.mutex.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	return producer.send(entries)
+}
+
+//Close send queued messages and stop the producer
+func (producer *BatchProducer) Close() error {
+	producer.mutex.Lock()
+	producer.once.Do(func() {
+		close(producer.closing)
+	})
+	producer.mutex.Unlock()
+
+	<-producer.done
+	return producer.Flush()
+}
+
+func (producer *BatchProducer) flushLoop() {
+	defer close(producer.done)
+
+	for {
+		select {
+		case <-producer.closing:
+			return
+		case <-producer.wakeup:
+		}
+
+		timer := time.NewTimer(producer.config.MaxDelay)
+		select {
+		case <-producer.closing:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := producer.Flush()
+		if err != nil {
+			producer.client.logger.Error("cannot send batch", slog.Any("error", err))
+		}
+	}
+}
+
+//send convert messages with send middleware and write all frames at once.
+//Messages rejected by middleware fail alone, errors of writing or of the receipt fail the whole batch.
+func (producer *BatchProducer) send(entries []*batchEntry) error {
+	client := producer.client
+	deliveryMode := DELIVERY_ASYNC
+	if producer.config.Receipt {
+		deliveryMode = DELIVERY_SYNC
+	}
+
+	frames := make([]*frame.Frame, 0, len(entries)+2)
+	batch := make([]*batchEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.span = client.startProducerSpan(entry.msg)
+
+		var frm *frame.Frame
+		collect := func(msg *message.Message, deliveryMode bool) error {
+			frm = client.sendFrame(msg)
+			return nil
+		}
+		err := client.sendChain(collect)(entry.msg, deliveryMode)
+		if err != nil {
+			entry.finish(err)
+			continue
+		}
+		frames = append(frames, frm)
+		batch = append(batch, entry)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var transactionId string
+	if producer.config.Transaction {
+		transactionId = uuid.New().String()
+		for _, frm := range frames {
+			frm.Headers[message.Transaction] = transactionId
+		}
+
+		begin := frame.NewFrame(frame.BEGIN, []byte(""))
+		begin.Headers[message.Transaction] = transactionId
+		commit := frame.NewFrame(frame.COMMIT, []byte(""))
+		commit.Headers[message.Transaction] = transactionId
+		frames = append([]*frame.Frame{begin}, append(frames, commit)...)
+	}
+
+	//receipts are sent in order, the receipt of the last frame confirms all frames of the batch
+	var waiter chan *frame.Frame
+	receiptId := "batch-" + uuid.New().String()
+	if producer.config.Receipt {
+		frames[len(frames)-1].Headers[message.Receipt] = receiptId
+		waiter = client.expectReceipt(receiptId)
+	}
+
+	sentAt := time.Now()
+	err := client.sender(frames...)
+	if err != nil {
+		if waiter != nil {
+			client.cancelReceipt(receiptId)
+		}
+		if transactionId != "" {
+			//the broker may have received BEGIN and some SEND frames
+			abort := frame.NewFrame(frame.ABORT, []byte(""))
+			abort.Headers[message.Transaction] = transactionId
+			client.sender(abort)
+		}
+	} else if waiter != nil {
+		err = client.awaitReceipt(receiptId, waiter)
+		if err == nil {
+			client.metrics.ReceiptLatency(time.Since(sentAt))
+		}
+	}
+
+	for _, entry := range batch {
+		if err == nil {
+			client.metrics.MessageSent(entry.msg.GetDestination())
+		}
+		entry.finish(err)
+	}
+	if err != nil {
+		return errors.New("Cannot send batch of " + strconv.Itoa(len(batch)) + " messages. Reason: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package gostomp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//failOnceConn fails the first write containing fail, other writes are recorded
+type failOnceConn struct {
+	recordingConn
+	fail   string
+	failed bool
+}
+
+func (conn *failOnceConn) Write(p []byte) (int, error) {
+	if !conn.failed && bytes.Contains(p, []byte(conn.fail)) {
+		conn.failed = true
+		return 0, errors.New("broken pipe")
+	}
+	return conn.recordingConn.Write(p)
+}
+
+func newBatchMessage(i int) *message.Message {
+	msg := message.New([]byte("order"))
+	msg.SetID("m" + strconv.Itoa(i))
+	msg.SetDestination("/queue/orders")
+	return msg
+}
+
+//awaitResults fail the test unless every result is received and equals expected
+func awaitResults(t *testing.T, results []<-chan error, expected error) {
+	t.Helper()
+
+	for i, result := range results {
+		select {
+		case err := <-result:
+			if !errors.Is(err, expected) {
+				t.Fatalf("message %d: expected %v, got %v", i, expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result of message %d", i)
+		}
+	}
+}
+
+func commands(frames []*frame.Frame) []string {
+	commands := make([]string, len(frames))
+	for i, frm := range frames {
+		commands[i] = frm.Command
+	}
+	return commands
+}
+
+func TestBatchProducerTransaction(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+	producer := NewBatchProducer(client, BatchConfig{MaxSize: 3, MaxDelay: time.Hour, Transaction: true, Receipt: true})
+	defer producer.Close()
+
+	results := make([]<-chan error, 0)
+	for i := 0; i < 2; i++ {
+		results = append(results, producer.Producer(newBatchMessage(i)))
+	}
+	//the message filling the batch writes it and waits for the receipt
+	go func() {
+		<-producer.Producer(newBatchMessage(2))
+	}()
+
+	begin := broker.expect(frame.BEGIN)
+	transactionId := begin[message.Transaction]
+	if transactionId == "" {
+		t.Fatal("BEGIN has no transaction")
+	}
+	for i := 0; i < 3; i++ {
+		send := broker.expect(frame.SEND)
+		if send[message.Transaction] != transactionId || send[message.MessageId] != "m"+strconv.Itoa(i) {
+			t.Fatalf("unexpected SEND %v", send)
+		}
+		if _, ok := send[message.Receipt]; ok {
+			t.Fatalf("SEND of a transaction requests a receipt: %v", send)
+		}
+	}
+	commit := broker.expect(frame.COMMIT)
+	if commit[message.Transaction] != transactionId || commit[message.Receipt] == "" {
+		t.Fatalf("unexpected COMMIT %v", commit)
+	}
+
+	select {
+	case err := <-results[0]:
+		t.Fatalf("result is reported before the receipt: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: commit[message.Receipt]})
+	awaitResults(t, results, nil)
+}
+
+func TestBatchProducerSingleReceipt(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+	producer := NewBatchProducer(client, BatchConfig{MaxDelay: time.Hour, Receipt: true})
+	defer producer.Close()
+
+	results := make([]<-chan error, 0)
+	for i := 0; i < 3; i++ {
+		results = append(results, producer.Producer(newBatchMessage(i)))
+	}
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- producer.Flush()
+	}()
+
+	var receiptId string
+	for i := 0; i < 3; i++ {
+		send := broker.expect(frame.SEND)
+		if _, ok := send[message.Transaction]; ok {
+			t.Fatalf("SEND without Transaction has a transaction: %v", send)
+		}
+		receipt, ok := send[message.Receipt]
+		if ok != (i == 2) {
+			t.Fatalf("receipt of SEND %d: %q", i, receipt)
+		}
+		receiptId = receipt
+	}
+	broker.send(frame.ERROR, map[string]string{message.ReceiptId: receiptId, message.Message_: "queue is full"})
+
+	var brokerErr *BrokerError
+	if err := <-flushed; err == nil {
+		t.Fatal("rejected batch is reported as sent")
+	}
+	for i, result := range results {
+		if err := <-result; !errors.As(err, &brokerErr) {
+			t.Fatalf("message %d: expected BrokerError, got %v", i, err)
+		}
+	}
+}
+
+func TestBatchProducerAbortsOnWriteError(t *testing.T) {
+	conn := &failOnceConn{fail: frame.BEGIN}
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.setConn(conn)
+	client.setState(StateConnected)
+	producer := NewBatchProducer(client, BatchConfig{MaxDelay: time.Hour, Transaction: true})
+	defer producer.Close()
+
+	results := []<-chan error{producer.Producer(newBatchMessage(0)), producer.Producer(newBatchMessage(1))}
+	if err := producer.Flush(); err == nil {
+		t.Fatal("write error is not reported")
+	}
+	for i, result := range results {
+		if err := <-result; err == nil {
+			t.Fatalf("message %d is reported as sent", i)
+		}
+	}
+
+	frames := conn.sent()
+	if !reflect.DeepEqual(commands(frames), []string{frame.ABORT}) || frames[0].Headers[message.Transaction] == "" {
+		t.Fatalf("expected ABORT of the transaction, got %v", commands(frames))
+	}
+}
+
+func TestBatchProducerFlushesOnMaxSize(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	producer := NewBatchProducer(client, BatchConfig{MaxSize: 2, MaxDelay: time.Hour})
+	defer producer.Close()
+
+	results := []<-chan error{producer.Producer(newBatchMessage(0))}
+	if frames := conn.sent(); len(frames) != 0 {
+		t.Fatalf("batch is written before it is full: %v", commands(frames))
+	}
+	results = append(results, producer.Producer(newBatchMessage(1)))
+	if frames := conn.sent(); !reflect.DeepEqual(commands(frames), []string{frame.SEND, frame.SEND}) {
+		t.Fatalf("full batch is not written: %v", commands(frames))
+	}
+	awaitResults(t, results, nil)
+}
+
+func TestBatchProducerFlushesAfterMaxDelay(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	producer := NewBatchProducer(client, BatchConfig{MaxDelay: 100 * time.Millisecond})
+	defer producer.Close()
+
+	queued := time.Now()
+	result := producer.Producer(newBatchMessage(0))
+	if frames := conn.sent(); len(frames) != 0 {
+		t.Fatalf("batch is written before MaxDelay: %v", commands(frames))
+	}
+	awaitResults(t, []<-chan error{result}, nil)
+	if elapsed := time.Since(queued); elapsed < 100*time.Millisecond {
+		t.Fatalf("batch is written after %s", elapsed)
+	}
+	if frames := conn.sent(); len(frames) != 1 || frames[0].Headers[message.MessageId] != "m0" {
+		t.Fatalf("unexpected frames %v", commands(frames))
+	}
+}
+
+func TestBatchProducerCloseDrainsQueue(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	producer := NewBatchProducer(client, BatchConfig{MaxDelay: time.Hour})
+
+	results := make([]<-chan error, 0)
+	for i := 0; i < 3; i++ {
+		results = append(results, producer.Producer(newBatchMessage(i)))
+	}
+	err := producer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitResults(t, results, nil)
+
+	frames := conn.sent()
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 messages written on Close, got %v", commands(frames))
+	}
+	for i, frm := range frames {
+		if frm.Headers[message.MessageId] != "m"+strconv.Itoa(i) {
+			t.Fatalf("messages are written out of order: %s at %d", frm.Headers[message.MessageId], i)
+		}
+	}
+
+	awaitResults(t, []<-chan error{producer.Producer(newBatchMessage(3))}, ErrBatchProducerClosed)
+}
@@ -0,0 +1,380 @@
+package gostomp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ChunkGroupId = "x-chunk-group-id"
+	ChunkIndex   = "x-chunk-index"
+	ChunkTotal   = "x-chunk-total"
+)
+
+//DefaultChunkTimeout is how long Reassembler waits for missing chunks of a group
+const DefaultChunkTimeout = 5 * time.Minute
+
+//ChunkingProducer splits bodies larger than ChunkSize into numbered chunk messages
+//which are joined back by Reassembler on the consumer side
+type ChunkingProducer struct {
+	client    *Client
+	ChunkSize int
+}
+
+func NewChunkingProducer(client *Client, chunkSize int) *ChunkingProducer {
+	return &ChunkingProducer{client: client, ChunkSize: chunkSize}
+}
+
+//Producer send the message as is if it fits into a single chunk, otherwise every chunk is sent with Client.Producer.
+//All chunks carry the headers of msg, the group id is the message id of msg.
+func (producer *ChunkingProducer) Producer(msg *message.Message, deliveryMode bool) error {
+	if producer.ChunkSize <= 0 {
+		return errors.New("chunk size must be positive")
+	}
+
+	body := msg.GetBody()
+	if len(body) <= producer.ChunkSize {
+		return producer.client.Producer(msg, deliveryMode)
+	}
+
+	if msg.GetID() == "" {
+		msg.SetID(uuid.New().String())
+	}
+	groupId := msg.GetID()
+	total := (len(body) + producer.ChunkSize - 1) / producer.ChunkSize
+
+	for index := 0; index < total; index++ {
+		end := (index + 1) * producer.ChunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+
+		chunk := copyMessage(msg, body[index*producer.ChunkSize:end])
+		chunk.SetID(groupId + "-" + strconv.Itoa(index))
+		chunk.SetHeader(ChunkGroupId, groupId)
+		chunk.SetHeader(ChunkIndex, strconv.Itoa(index))
+		chunk.SetHeader(ChunkTotal, strconv.Itoa(total))
+
+		err := producer.client.Producer(chunk, deliveryMode)
+		if err != nil {
+			return errors.New("Cannot send chunk " + strconv.Itoa(index) + " of " + groupId + ". Reason: " + err.Error())
+		}
+	}
+	return nil
+}
+
+//ReassemblerConfig describes how chunks are buffered until their group is complete
+type ReassemblerConfig struct {
+	//Timeout drops incomplete groups, DefaultChunkTimeout if zero
+	Timeout time.Duration
+	//SpillDir enables buffering of chunks in temporary files under this directory, "" keeps chunks in memory
+	SpillDir string
+	//SpillThreshold is the number of buffered bytes of a group after which its chunks are written to SpillDir
+	SpillThreshold int
+}
+
+//Reassembler is a ConsumeMiddleware which joins chunks sent by ChunkingProducer
+//and calls the callback once with a single message.
+//
+//The message handed to the callback carries the ack header of the chunk which was delivered last.
+//With ACK_CLIENT the cumulative ACK of it covers the chunks delivered before, with AckBatchSize
+//or AckBatchInterval Client.Ack marks all chunks of the group as processed. With ACK_CLIENT_INDIVIDUAL
+//the Reassembler acknowledges the other chunks of the group itself.
+type Reassembler struct {
+	client *Client
+	config ReassemblerConfig
+	mutex  sync.Mutex
+	groups map[string]*chunkGroup
+	//expiring is set while expireLoop runs, it stops when no group is incomplete
+	expiring bool
+	closing  chan struct{}
+	once     sync.Once
+}
+
+type chunkGroup struct {
+	total   int
+	chunks  map[int][]byte
+	spilled map[int]bool
+	//messages are the delivered chunks without bodies, they are kept to acknowledge or reject the chunks
+	messages []*message.Message
+	buffered int
+	dir      string
+	started  time.Time
+}
+
+//NewReassembler create reassembler, use its Middleware in Subscription.Middleware or WithConsumeMiddleware
+func (client *Client) NewReassembler(config ReassemblerConfig) *Reassembler {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultChunkTimeout
+	}
+
+	return &Reassembler{
+		client:  client,
+		config:  config,
+		groups:  make(map[string]*chunkGroup),
+		closing: make(chan struct{}),
+	}
+}
+
+//Middleware pass messages without chunk headers through and collects chunks until their group is complete
+func (reassembler *Reassembler) Middleware(next SubscriptionCallback) SubscriptionCallback {
+	return func(msg *message.Message) {
+		headers := msg.GetHeaders()
+		groupId, ok := headers[ChunkGroupId]
+		if !ok {
+			next(msg)
+			return
+		}
+
+		complete, err := reassembler.add(groupId, msg)
+		if err != nil {
+			reassembler.client.logger.Error("cannot buffer message chunk",
+				slog.String("group", groupId),
+				slog.String("message-id", msg.GetID()),
+				slog.Any("error", err),
+			)
+			reassembler.client.reject(msg)
+			return
+		}
+		if complete == nil {
+			return
+		}
+
+		logical, err := reassembler.assemble(groupId, complete)
+		if err != nil {
+			reassembler.client.logger.Error("cannot reassemble message chunks", slog.String("group", groupId), slog.Any("error", err))
+			for _, chunk := range complete.messages {
+				reassembler.client.reject(chunk)
+			}
+			return
+		}
+		next(logical)
+	}
+}
+
+//Close drop incomplete groups and remove their spilled chunks
+func (reassembler *Reassembler) Close() {
+	reassembler.once.Do(func() {
+		close(reassembler.closing)
+
+		reassembler.mutex.Lock()
+		defer reassembler.mutex.Unlock()
+		for groupId, group := range reassembler.groups {
+			group.cleanup()
+			delete(reassembler.groups, groupId)
+		}
+	})
+}
+
+//add store the chunk and returns the group when all its chunks have arrived
+func (reassembler *Reassembler) add(groupId string, msg *message.Message) (*chunkGroup, error) {
+	headers := msg.GetHeaders()
+	index, err := strconv.Atoi(headers[ChunkIndex])
+	if err != nil {
+		return nil, errors.New("invalid " + ChunkIndex + " header")
+	}
+	total, err := strconv.Atoi(headers[ChunkTotal])
+	if err != nil || total <= 0 || index < 0 || index >= total {
+		return nil, errors.New("invalid " + ChunkTotal + " header")
+	}
+
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+
+	group, ok := reassembler.groups[groupId]
+	if !ok {
+		group = &chunkGroup{
+			total:   total,
+			chunks:  make(map[int][]byte),
+			spilled: make(map[int]bool),
+			started: time.Now(),
+		}
+		reassembler.groups[groupId] = group
+
+		if !reassembler.expiring {
+			reassembler.expiring = true
+			go reassembler.expireLoop()
+		}
+	}
+	if group.total != total {
+		return nil, errors.New("chunk total does not match the group")
+	}
+
+	//the body is buffered in chunks or spilled, the message must not keep it in memory
+	body := msg.GetBody()
+	msg.SetBody(nil)
+	group.messages = append(group.messages, msg)
+	if _, duplicate := group.chunks[index]; duplicate {
+		return nil, nil
+	}
+
+	group.buffered += len(body)
+	group.chunks[index] = body
+	if reassembler.config.SpillDir != "" && group.buffered > reassembler.config.SpillThreshold {
+		//chunks buffered before the threshold was crossed are moved to disk as well
+		for chunkIndex, chunk := range group.chunks {
+			if group.spilled[chunkIndex] {
+				continue
+			}
+			err = group.spill(reassembler.config.SpillDir, chunkIndex, chunk)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(group.chunks) < group.total {
+		return nil, nil
+	}
+	delete(reassembler.groups, groupId)
+	return group, nil
+}
+
+//assemble join chunks of the complete group into a single message
+func (reassembler *Reassembler) assemble(groupId string, group *chunkGroup) (*message.Message, error) {
+	defer group.cleanup()
+
+	var body bytes.Buffer
+	body.Grow(group.buffered)
+	for index := 0; index < group.total; index++ {
+		chunk := group.chunks[index]
+		if group.spilled[index] {
+			var err error
+			chunk, err = os.ReadFile(group.chunkPath(index))
+			if err != nil {
+				return nil, err
+			}
+		}
+		body.Write(chunk)
+	}
+
+	last := reassembler.lastDelivered(group.messages)
+	logical := copyMessage(last, body.Bytes())
+	logical.SetID(groupId)
+	delete(logical.GetHeaders(), ChunkGroupId)
+	delete(logical.GetHeaders(), ChunkIndex)
+	delete(logical.GetHeaders(), ChunkTotal)
+	logical.SetHeader(message.ContentLength, strconv.Itoa(body.Len()))
+
+	subscription := reassembler.client.subscriptionByID(last.GetHeaders()[message.Subscription])
+	if subscription == nil || subscription.tracker == nil {
+		return logical, nil
+	}
+	switch subscription.Ack {
+	case ACK_CLIENT_INDIVIDUAL:
+		for _, chunk := range group.messages {
+			if chunk != last {
+				reassembler.client.Ack(chunk)
+			}
+		}
+	case ACK_CLIENT:
+		//a batched Ack of the logical message marks the other chunks too, otherwise the checkpoint never passes them
+		ackIds := make([]string, 0, len(group.messages)-1)
+		for _, chunk := range group.messages {
+			if chunk != last {
+				ackIds = append(ackIds, chunk.GetHeaders()[message.Ack])
+			}
+		}
+		subscription.tracker.join(last.GetHeaders()[message.Ack], ackIds)
+	}
+	return logical, nil
+}
+
+//lastDelivered returns the chunk delivered last by the broker.
+//Chunks are handled by concurrent callbacks, so the chunk added last may have been delivered earlier,
+//a cumulative ACK of its ack id would leave the later chunks unacknowledged.
+func (reassembler *Reassembler) lastDelivered(chunks []*message.Message) *message.Message {
+	last := chunks[len(chunks)-1]
+	subscription := reassembler.client.subscriptionByID(last.GetHeaders()[message.Subscription])
+	if subscription == nil || subscription.tracker == nil {
+		return last
+	}
+
+	ackIds := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		ackIds[i] = chunk.GetHeaders()[message.Ack]
+	}
+	index := subscription.tracker.lastDelivered(ackIds)
+	if index < 0 {
+		return last
+	}
+	return chunks[index]
+}
+
+//expireLoop drop groups which did not complete within the timeout, it returns when no group is left
+func (reassembler *Reassembler) expireLoop() {
+	ticker := time.NewTicker(reassembler.config.Timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-reassembler.closing:
+			return
+		case <-ticker.C:
+			reassembler.mutex.Lock()
+			expired := make(map[string]*chunkGroup)
+			for groupId, group := range reassembler.groups {
+				if time.Since(group.started) > reassembler.config.Timeout {
+					expired[groupId] = group
+					delete(reassembler.groups, groupId)
+				}
+			}
+			idle := len(reassembler.groups) == 0
+			if idle {
+				reassembler.expiring = false
+			}
+			reassembler.mutex.Unlock()
+
+			for groupId, group := range expired {
+				reassembler.client.logger.Warn("incomplete chunk group expired",
+					slog.String("group", groupId),
+					slog.Int("received", len(group.chunks)),
+					slog.Int("total", group.total),
+				)
+				for _, chunk := range group.messages {
+					reassembler.client.reject(chunk)
+				}
+				group.cleanup()
+			}
+			if idle {
+				return
+			}
+		}
+	}
+}
+
+func (group *chunkGroup) spill(spillDir string, index int, body []byte) error {
+	if group.dir == "" {
+		dir, err := os.MkdirTemp(spillDir, "gostomp-chunks-")
+		if err != nil {
+			return err
+		}
+		group.dir = dir
+	}
+
+	err := os.WriteFile(group.chunkPath(index), body, 0600)
+	if err != nil {
+		return err
+	}
+	group.chunks[index] = nil
+	group.spilled[index] = true
+	return nil
+}
+
+func (group *chunkGroup) chunkPath(index int) string {
+	return filepath.Join(group.dir, strconv.Itoa(index))
+}
+
+func (group *chunkGroup) cleanup() {
+	if group.dir != "" {
+		os.RemoveAll(group.dir)
+	}
+}
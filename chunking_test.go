@@ -0,0 +1,274 @@
+package gostomp
+
+import (
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//sent returns frames written by the client with headers and body
+func (conn *recordingConn) sent() []*frame.Frame {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	frames := make([]*frame.Frame, 0)
+	for _, raw := range strings.Split(conn.written.String(), "\x00") {
+		head, body, ok := strings.Cut(strings.TrimLeft(raw, "\n"), "\n\n")
+		if !ok {
+			continue
+		}
+		lines := strings.Split(head, "\n")
+		frm := frame.NewFrame(lines[0], []byte(body))
+		for _, line := range lines[1:] {
+			key, value, _ := strings.Cut(line, ":")
+			frm.Headers[key] = value
+		}
+		frames = append(frames, frm)
+	}
+	return frames
+}
+
+//newChunk returns a delivery of chunk index of the group to subscription "sub-1"
+func newChunk(ackId, groupId string, index, total int, body string) *message.Message {
+	msg := newDelivery(ackId)
+	msg.SetBody([]byte(body))
+	msg.SetHeader(message.Destination, "/queue/orders")
+	msg.SetHeader(ChunkGroupId, groupId)
+	msg.SetHeader(ChunkIndex, strconv.Itoa(index))
+	msg.SetHeader(ChunkTotal, strconv.Itoa(total))
+	return msg
+}
+
+//reassemble returns a reassembler of client and the channel receiving messages of its callback
+func reassemble(t *testing.T, client *Client, config ReassemblerConfig, callback func(msg *message.Message)) (*Reassembler, SubscriptionCallback) {
+	t.Helper()
+
+	reassembler := client.NewReassembler(config)
+	t.Cleanup(reassembler.Close)
+	return reassembler, reassembler.Middleware(callback)
+}
+
+func TestChunkingProducerSplitsBody(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	producer := NewChunkingProducer(client, 4)
+
+	msg := message.New([]byte("abcdefghij"))
+	msg.SetID("order-1")
+	msg.SetDestination("/queue/orders")
+	msg.SetCorrelationId("c1")
+	err := producer.Producer(msg, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := message.New([]byte("abcd"))
+	small.SetDestination("/queue/orders")
+	err = producer.Producer(small, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frames := conn.sent()
+	if len(frames) != 4 {
+		t.Fatalf("expected 3 chunks and a message, got %d frames", len(frames))
+	}
+	for index, body := range []string{"abcd", "efgh", "ij"} {
+		frm := frames[index]
+		expected := map[string]string{
+			message.MessageId:     "order-1-" + strconv.Itoa(index),
+			ChunkGroupId:          "order-1",
+			ChunkIndex:            strconv.Itoa(index),
+			ChunkTotal:            "3",
+			message.CorrelationId: "c1",
+		}
+		for key, value := range expected {
+			if frm.Headers[key] != value {
+				t.Errorf("chunk %d: header %s is %q instead of %q", index, key, frm.Headers[key], value)
+			}
+		}
+		if string(frm.Body) != body {
+			t.Errorf("chunk %d: body %q instead of %q", index, frm.Body, body)
+		}
+	}
+	if _, ok := frames[3].Headers[ChunkGroupId]; ok || string(frames[3].Body) != "abcd" {
+		t.Fatal("message which fits into a chunk is split")
+	}
+
+	if err := NewChunkingProducer(client, 0).Producer(msg, DELIVERY_ASYNC); err == nil {
+		t.Fatal("chunk size 0 is accepted")
+	}
+}
+
+func TestReassemblerJoinsChunksInAnyOrder(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	client.addSubscriptions(&Subscription{id: "sub-1", Destination: "/queue/orders"})
+
+	received := make([]*message.Message, 0)
+	_, callback := reassemble(t, client, ReassemblerConfig{}, func(msg *message.Message) {
+		received = append(received, msg)
+	})
+
+	plain := newDelivery("0")
+	callback(plain)
+	callback(newChunk("1", "order-1", 2, 3, "ij"))
+	callback(newChunk("2", "order-1", 0, 3, "abcd"))
+	callback(newChunk("3", "order-1", 0, 3, "abcd"))
+	callback(newChunk("4", "order-1", 1, 3, "efgh"))
+
+	if len(received) != 2 || received[0] != plain {
+		t.Fatalf("expected the plain message and one reassembled message, got %d messages", len(received))
+	}
+	logical := received[1]
+	if string(logical.GetBody()) != "abcdefghij" {
+		t.Fatalf("unexpected body %q", logical.GetBody())
+	}
+	if logical.GetID() != "order-1" || logical.GetHeaders()[message.ContentLength] != "10" {
+		t.Fatalf("unexpected message-id %q or content-length %q", logical.GetID(), logical.GetHeaders()[message.ContentLength])
+	}
+	for _, key := range []string{ChunkGroupId, ChunkIndex, ChunkTotal} {
+		if _, ok := logical.GetHeaders()[key]; ok {
+			t.Fatalf("header %s is left on the reassembled message", key)
+		}
+	}
+}
+
+func TestReassemblerSpillReleasesBodies(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	client.addSubscriptions(&Subscription{id: "sub-1", Destination: "/queue/orders"})
+
+	dir := t.TempDir()
+	var logical *message.Message
+	reassembler, callback := reassemble(t, client, ReassemblerConfig{SpillDir: dir, SpillThreshold: 4}, func(msg *message.Message) {
+		logical = msg
+	})
+
+	chunks := []*message.Message{
+		newChunk("1", "order-1", 0, 3, "abcd"),
+		newChunk("2", "order-1", 1, 3, "efgh"),
+	}
+	for _, chunk := range chunks {
+		callback(chunk)
+	}
+
+	reassembler.mutex.Lock()
+	group := reassembler.groups["order-1"]
+	for index, body := range group.chunks {
+		if body != nil || !group.spilled[index] {
+			t.Errorf("chunk %d is kept in memory", index)
+		}
+	}
+	reassembler.mutex.Unlock()
+	for _, chunk := range chunks {
+		if chunk.GetBody() != nil {
+			t.Errorf("message of chunk %s keeps its body", chunk.GetID())
+		}
+	}
+	if entries, _ := os.ReadDir(group.dir); len(entries) != 2 {
+		t.Fatalf("expected 2 spilled chunks, got %d", len(entries))
+	}
+
+	callback(newChunk("3", "order-1", 2, 3, "ij"))
+	if logical == nil || string(logical.GetBody()) != "abcdefghij" {
+		t.Fatal("spilled chunks are not reassembled")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("spilled chunks are not removed: %d entries", len(entries))
+	}
+}
+
+func TestReassemblerExpiresIncompleteGroup(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	subscription := newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1", "2")
+
+	reassembler, callback := reassemble(t, client, ReassemblerConfig{Timeout: 20 * time.Millisecond}, func(msg *message.Message) {
+		t.Error("callback is called for an incomplete group")
+	})
+	callback(newChunk("1", "order-1", 0, 3, "abcd"))
+	callback(newChunk("2", "order-1", 1, 3, "efgh"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(conn.frames()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"NACK 1", "NACK 2"}) && !reflect.DeepEqual(frames, []string{"NACK 2", "NACK 1"}) {
+		t.Fatalf("expected NACK of both chunks, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); len(unacked) != 0 {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	if len(reassembler.groups) != 0 {
+		t.Fatal("expired group is kept")
+	}
+}
+
+func TestReassemblerRejectsInvalidChunk(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1", "2")
+
+	_, callback := reassemble(t, client, ReassemblerConfig{}, func(msg *message.Message) {
+		t.Error("callback is called for an invalid chunk")
+	})
+	callback(newChunk("1", "order-1", 3, 3, "abcd"))
+	callback(newChunk("2", "order-2", 0, 0, "abcd"))
+
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"NACK 1", "NACK 2"}) {
+		t.Fatalf("expected NACK of invalid chunks, got %v", frames)
+	}
+}
+
+func TestReassemblerAcksChunksIndividually(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	subscription := newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1", "2", "3")
+
+	_, callback := reassemble(t, client, ReassemblerConfig{}, func(msg *message.Message) {
+		if ackId := msg.GetHeaders()[message.Ack]; ackId != "3" {
+			t.Errorf("reassembled message carries ack id %s of a chunk delivered earlier", ackId)
+		}
+		client.Ack(msg)
+	})
+	callback(newChunk("1", "order-1", 1, 3, "efgh"))
+	callback(newChunk("3", "order-1", 2, 3, "ij"))
+	callback(newChunk("2", "order-1", 0, 3, "abcd"))
+
+	frames := conn.frames()
+	sort.Strings(frames)
+	if !reflect.DeepEqual(frames, []string{"ACK 1", "ACK 2", "ACK 3"}) {
+		t.Fatalf("expected ACK of every chunk, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); len(unacked) != 0 {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+}
+
+func TestReassemblerWithBatchedAcks(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	subscription := newTrackedSubscription(client, ACK_CLIENT, "1", "2", "3", "4")
+	subscription.AckBatchSize = 3
+
+	_, callback := reassemble(t, client, ReassemblerConfig{}, func(msg *message.Message) {
+		client.Ack(msg)
+	})
+	callback(newChunk("1", "order-1", 0, 3, "abcd"))
+	callback(newChunk("2", "order-1", 1, 3, "efgh"))
+	callback(newChunk("3", "order-1", 2, 3, "ij"))
+
+	if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"ACK 3"}) {
+		t.Fatalf("expected cumulative ACK of all chunks, got %v", frames)
+	}
+	if unacked := subscription.Unacked(); !reflect.DeepEqual(unacked, []string{"m4"}) {
+		t.Fatalf("unexpected unacknowledged messages %v", unacked)
+	}
+}
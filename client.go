@@ -1,16 +1,22 @@
 package gostomp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/msidorenko/gostomp/frame"
 	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const DELIVERY_SYNC = true
@@ -19,13 +25,96 @@ const DELIVERY_ASYNC = false
 type Client struct {
 	connection Connection
 	session    []Session
-	Errors     chan error
+	//Errors receives connection errors, they are dropped when DefaultErrorsBuffer of them are not read.
+	//Hooks.OnError is called for the same errors.
+	Errors         chan error
+	logger         *slog.Logger
+	frameTrace     bool
+	traceBodyLimit int
+	metrics        Metrics
+	propagator     TextMapPropagator
+	tracer         Tracer
+
+	sendMiddleware    []SendMiddleware
+	consumeMiddleware []ConsumeMiddleware
+
+	compression            *CompressionConfig
+	destinationCompression map[string]CompressionConfig
+	maxDecompressedSize    int
+	envelope               *EnvelopeConfig
+
+	dialect Dialect
+
+	receipts       map[string]chan *frame.Frame
+	receiptsMutex  sync.Mutex
+	receiptTimeout time.Duration
+
+	subscriptions      []*Subscription
+	subscriptionsMutex sync.RWMutex
+
+	writeMutex sync.Mutex
+	//connMutex guards the socket pointer, it is not held while writing so a blocked write can be interrupted
+	connMutex sync.Mutex
+	//handlers counts running subscription callbacks, Shutdown waits for them
+	handlers sync.WaitGroup
+	//handlersStopped is set when Shutdown waits for handlers, no callback is started afterwards
+	handlersStopped bool
+	//ackHandlers counts running callbacks of client ack modes, Shutdown flushes their ACKs before UNSUBSCRIBE
+	ackHandlers sync.WaitGroup
+	//ackHandlersStopped is set when Shutdown waits for ackHandlers, no callback of client ack modes is started afterwards
+	ackHandlersStopped bool
+	handlersMutex      sync.Mutex
+
+	state      atomic.Int32
+	stateMutex sync.Mutex
+	//connectedSignal is closed when the state becomes StateConnected
+	connectedSignal chan struct{}
+	//stop is closed when the state becomes StateClosed, background goroutines of the client exit then
+	stop chan struct{}
+	//hooksDone is closed when the hooks goroutine of the previous connection exits
+	hooksDone chan struct{}
+
+	hooks      Hooks
+	events     chan func()
+	reconnect  *ReconnectPolicy
+	retry      *RetryPolicy
+	scheduler  *scheduler
+	dispatcher *dispatcher
+
+	//connected is set after the first successful CONNECT to detect reconnects
+	connected bool
+	//lastReceived is unix time in nanoseconds of the last data read from the server
+	lastReceived atomic.Int64
+	//inbox queues MESSAGE frames of the current connection for delivery
+	inbox atomic.Pointer[inbox]
+	//flowPaused is set while delivery waits for a free slot of a subscription window or a full buffer
+	flowPaused atomic.Bool
+	//lastSent is unix time in nanoseconds of the last frame written to the server
+	lastSent atomic.Int64
+	//draining is set by Shutdown, subscriptions detached by flow control are not subscribed again
+	draining atomic.Bool
 }
 
-var ReceiptPool = make(map[string]chan *frame.Frame)
+//ClientOption configures optional settings of the Client in NewClient
+type ClientOption func(client *Client)
+
+//WithCredentialsProvider set the source of login and passcode for the CONNECT frame.
+//It takes precedence over the credentials passed in the DSN userinfo.
+func WithCredentialsProvider(provider CredentialsProvider) ClientOption {
+	return func(client *Client) {
+		client.connection.credentials = provider
+	}
+}
+
+//WithClientID set client-id header of the CONNECT frame, brokers use it to identify durable subscriptions
+func WithClientID(clientId string) ClientOption {
+	return func(client *Client) {
+		client.connection.clientId = clientId
+	}
+}
 
 //NewClient create object with basic settings for client connection
-func NewClient(dsn string) (*Client, error) {
+func NewClient(dsn string, options ...ClientOption) (*Client, error) {
 	u, err := url.Parse(dsn)
 	if err != nil {
 		return nil, err
@@ -35,7 +124,6 @@ func NewClient(dsn string) (*Client, error) {
 		ssl:             false,
 		protocol:        u.Scheme,
 		addr:            u.Host,
-		tryDisconnect:   false,
 		heartBeatServer: 0,
 		heartBeatClient: 0,
 	}
@@ -55,37 +143,72 @@ func NewClient(dsn string) (*Client, error) {
 	}
 
 	if len(u.User.Username()) > 0 {
-		conn.login = u.User.Username()
-	}
-
-	password, isset := u.User.Password()
-	if isset {
-		conn.password = password
+		password, _ := u.User.Password()
+		conn.credentials = StaticCredentials(u.User.Username(), password)
 	}
 
 	hb := u.Query().Get("heart-beat")
 	if len(hb) > 0 {
-		hbsettings := strings.Split(hb, ",")
-		conn.heartBeatClient, err = strconv.ParseInt(hbsettings[0], 10, 64)
+		conn.requestedHeartBeatClient, conn.requestedHeartBeatServer, err = parseHeartBeat(hb)
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf(hbsettings[0] + " is not a integer"))
-		}
-		conn.heartBeatServer, err = strconv.ParseInt(hbsettings[1], 10, 64)
-		if err != nil {
-			return nil, errors.New(fmt.Sprintf(hbsettings[1] + " is not a integer"))
+			return nil, errors.New("Cannot parse heart-beat of the DSN. Reason: " + err.Error())
 		}
 	}
 
+	dialect, err := DialectByName(u.Query().Get("dialect"))
+	if err != nil {
+		return nil, err
+	}
+
 	client := &Client{
 		connection: conn,
-		Errors:     make(chan error),
+		Errors:     make(chan error, DefaultErrorsBuffer),
+		logger:     slog.Default(),
+		metrics:    noopMetrics{},
+		dialect:    dialect,
+
+		maxDecompressedSize: DefaultMaxDecompressedSize,
+	}
+
+	for _, option := range options {
+		option(client)
 	}
+	client.logger = client.logger.With(slog.String("addr", conn.addr))
 	return client, nil
 }
 
 //Connect method establish connection with the Message Broker server and authorize via CONNECT command
 //@TODO check all of servers for failover
 func (client *Client) Connect() error {
+	client.setState(StateConnecting)
+	client.draining.Store(false)
+	client.handlersMutex.Lock()
+	client.handlersStopped = false
+	client.ackHandlersStopped = false
+	client.handlersMutex.Unlock()
+	client.startBackground()
+	err := client.connect(StateConnecting)
+	if err != nil {
+		client.setState(StateClosed)
+		return err
+	}
+	client.emitConnected()
+	return nil
+}
+
+//connect open the socket, exchange CONNECT and CONNECTED frames and start I/O goroutines.
+//It fails if the state is not the expected one anymore, e.g. Disconnect was called meanwhile.
+func (client *Client) connect(expected State) error {
+	//Credentials are requested on every connect so rotated secrets are used
+	var credentials Credentials
+	if client.connection.credentials != nil {
+		var err error
+		credentials, err = client.connection.credentials.Credentials()
+		if err != nil {
+			return errors.New("Cannot get credentials. Reason: " + err.Error())
+		}
+	}
+
 	c, err := net.Dial(client.connection.protocol, client.connection.addr)
 	if err != nil {
 		return err
@@ -99,97 +222,182 @@ func (client *Client) Connect() error {
 		c := tls.Client(c, tlsConfig)
 		err = c.Handshake()
 		if err != nil {
-			println(err.Error())
-		} else {
-			client.connection.conn = c
+			client.logger.Error("TLS handshake failed", slog.Any("error", err))
+			c.Close()
+			return err
 		}
+		client.setConn(c)
 	} else {
-		client.connection.conn = c
+		client.setConn(c)
 	}
 
 	//After established network connection, we try send CONNECT frame to the message broker
 	connectFrame := frame.NewFrame(frame.CONNECT, []byte(""))
 
 	//In some cases we need to do auth by login and password
-	if client.connection.login != "" {
-		connectFrame.AddHeader(message.Login, client.connection.login)
-		if client.connection.password != "" {
-			connectFrame.AddHeader(message.Passcode, client.connection.password)
+	if credentials.Login != "" {
+		connectFrame.AddHeader(message.Login, credentials.Login)
+		if credentials.Passcode != "" {
+			connectFrame.AddHeader(message.Passcode, credentials.Passcode)
 		}
 	}
 
 	connectFrame.AddHeader(message.AcceptVersion, "1.0,1.1,1.2")
 
+	if client.connection.clientId != "" {
+		connectFrame.AddHeader(message.ClientId, client.connection.clientId)
+	}
+
 	host, _, err := net.SplitHostPort(client.connection.addr)
 	if err == nil {
 		connectFrame.AddHeader(message.Host, host)
 	}
 
+	client.connection.heartBeatClient = client.connection.requestedHeartBeatClient
+	client.connection.heartBeatServer = client.connection.requestedHeartBeatServer
 	connectFrame.AddHeader(message.Heartbeat, fmt.Sprint(client.connection.heartBeatClient)+","+fmt.Sprint(client.connection.heartBeatServer))
 	connectFrame.AddHeader(message.Receipt, uuid.New().String())
 
 	err = client.sender(connectFrame)
 	if err != nil {
+		client.connection.conn.Close()
 		return err
 	}
 
 	reader := NewReader(client.connection.conn, 4096)
 	frm, err := reader.Read()
 	if err != nil {
+		client.logger.Error("cannot read CONNECTED frame", slog.Any("error", err))
+		client.connection.conn.Close()
 		return err
 	}
+	if frm != nil && frm.Command == frame.ERROR {
+		client.connection.conn.Close()
+		return newBrokerError(frm)
+	}
 
 	if frm != nil {
+		client.traceFrame("RX", frm)
+		client.metrics.FrameReceived(frm.Command, int(reader.BytesRead()))
 		client.connection.server = frm.Headers[message.Server]
 		client.connection.version = strings.Split(frm.Headers[message.Session], ",")
 
-		heartbeat := frm.Headers[message.Heartbeat]
-		if len(heartbeat) > 0 {
-			hbsettings := strings.Split(heartbeat, ",")
+		heartbeat, ok := frm.Headers[message.Heartbeat]
+		if !ok {
+			//a missing header is the same as 0,0
+			client.connection.heartBeatServer = 0
+			client.connection.heartBeatClient = 0
+		} else {
+			serverServerHeartBeat, serverClientsHeartBeat, err := parseHeartBeat(heartbeat)
+			if err != nil {
+				client.connection.conn.Close()
+				return errors.New("Cannot negotiate heart-beat. Reason: " + err.Error())
+			}
 
-			serverServerHeartBeat, _ := strconv.ParseInt(hbsettings[0], 10, 64)
-			if client.connection.heartBeatServer < serverServerHeartBeat {
+			//if either side sends 0 then there will be no heart-beats in that direction
+			if serverServerHeartBeat == 0 {
+				client.connection.heartBeatServer = 0
+			} else if client.connection.heartBeatServer != 0 && client.connection.heartBeatServer < serverServerHeartBeat {
 				client.connection.heartBeatServer = serverServerHeartBeat
 			}
 
-			//if hbsettings[1] == 0 then the server does not want to receive heart-beats else client MUST sent msg every max(client.connection.heartBeatClient, hbsettings[1]) milliseconds
-			serverClientsHeartBeat, _ := strconv.ParseInt(hbsettings[1], 10, 64)
-			if client.connection.heartBeatClient < serverClientsHeartBeat {
+			//if serverClientsHeartBeat == 0 then the server does not want to receive heart-beats else client MUST sent msg every max(client.connection.heartBeatClient, serverClientsHeartBeat) milliseconds
+			if serverClientsHeartBeat == 0 {
+				client.connection.heartBeatClient = 0
+			} else if client.connection.heartBeatClient != 0 && client.connection.heartBeatClient < serverClientsHeartBeat {
 				client.connection.heartBeatClient = serverClientsHeartBeat
 			}
 		}
 
 		client.session = make([]Session, 0)
 		client.session = append(client.session, Session{id: frm.Headers[message.Session]})
+
+		client.logger.Info("connected",
+			slog.String("server", client.connection.server),
+			slog.String("session", frm.Headers[message.Session]),
+		)
+	}
+
+	if client.connected {
+		client.metrics.Reconnected()
 	}
+	client.connected = true
 
 	//Start gourtine for continuously read from socket
-	go client.readerLoop(reader)
+	done := make(chan struct{})
+	inbox := newInbox()
+	client.inbox.Store(inbox)
+	client.lastReceived.Store(time.Now().UnixNano())
+	if !client.changeState(expected, StateConnected) {
+		client.connection.conn.Close()
+		return errors.New("Cannot connect. Reason: the state changed to " + client.State().String())
+	}
+	go client.readerLoop(reader, inbox, done)
+	go client.deliverLoop(inbox)
+	go client.monitorHeartBeats(client.connection.conn, inbox, done)
+	go client.sendHeartBeats(done)
 	return nil
 }
 
+//setConn replace the socket, frames written concurrently by callbacks must not go to a half set connection
+func (client *Client) setConn(conn io.ReadWriteCloser) {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	client.connMutex.Lock()
+	defer client.connMutex.Unlock()
+
+	client.connection.conn = conn
+}
+
+//closeConn close the socket, if there is one, without waiting for a blocked write
+func (client *Client) closeConn() {
+	client.connMutex.Lock()
+	conn := client.connection.conn
+	client.connMutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
 //Disconnect method will close connection with Message broker
 //Client send DISCONNECT header with receipt header and wait for ack from message broker
 //@TODO add support multiply servers
 func (client *Client) Disconnect() error {
+	return client.disconnect(context.Background())
+}
 
-	client.connection.tryDisconnect = true
+func (client *Client) disconnect(ctx context.Context) error {
+	if client.State() == StateClosed {
+		return ErrNotConnected
+	}
+	client.setState(StateDisconnecting)
+	defer client.closed(nil)
 
+	receiptId := uuid.New().String()
 	frm := frame.NewFrame(frame.DISCONNECT, nil)
-	frm.Headers[message.Receipt] = "77"
-	ReceiptPool["77"] = make(chan *frame.Frame)
+	frm.Headers[message.Receipt] = receiptId
+	waiter := client.expectReceipt(receiptId)
 
 	err := client.sender(frm)
 	if err != nil {
+		client.cancelReceipt(receiptId)
 		return err
 	}
 
-	_, ok := <-ReceiptPool["77"]
-	if !ok {
-		return errors.New("ERROR: cannot get receipt  frame from channel")
+	return client.awaitReceiptContext(ctx, receiptId, waiter)
+}
+
+//closed close the socket after DISCONNECT or when Shutdown gives up
+func (client *Client) closed(err error) {
+	client.closeConn()
+	if inbox := client.inbox.Load(); inbox != nil {
+		//the reader may wait for flow control and would not notice the closed socket
+		inbox.stop()
 	}
-	close(ReceiptPool["77"])
-	return nil
+	//events are queued before StateClosed stops the hooks goroutine
+	client.emitDisconnected(err)
+	client.setState(StateClosed)
 }
 
 //Producer method send a Message to the Message Broker
@@ -198,65 +406,164 @@ func (client *Client) Disconnect() error {
 //async - just push frame to the socket and forget about it. deliveryMode == false
 //sync - push frame to the socket and wait confirm message from the Message broker. deliveryMode == true
 func (client *Client) Producer(msg *message.Message, deliveryMode bool) error {
-	frm := frame.NewFrame("SEND", msg.GetBody())
+	return client.produce(context.Background(), msg, deliveryMode)
+}
+
+//produce send the message like Producer, waiting for the receipt and between retries ends when ctx is done
+func (client *Client) produce(ctx context.Context, msg *message.Message, deliveryMode bool) error {
+	if msg.GetID() == "" {
+		msg.SetID(uuid.New().String())
+	}
+
+	span := client.startProducerSpan(msg)
+	err := client.sendWithRetry(ctx, client.sendChain(client.send(ctx)), msg, deliveryMode)
+	if span != nil {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+	return err
+}
+
+//send returns SendFunc which converts the message to SEND frame and writes it to the socket,
+//the receipt is awaited until ctx is done
+func (client *Client) send(ctx context.Context) SendFunc {
+	return func(msg *message.Message, deliveryMode bool) error {
+		frm := client.sendFrame(msg)
+
+		msgId := msg.GetID()
+		var waiter chan *frame.Frame
+		if deliveryMode == DELIVERY_SYNC {
+			frm.Headers[message.Receipt] = msgId
+			waiter = client.expectReceipt(msgId)
+		}
+
+		sentAt := time.Now()
+		err := client.sender(frm)
+		if err != nil {
+			if waiter != nil {
+				client.cancelReceipt(msgId)
+			}
+			return err
+		}
+
+		if deliveryMode == DELIVERY_SYNC {
+			err = client.awaitReceiptContext(ctx, msgId, waiter)
+			if err != nil {
+				return err
+			}
+			client.metrics.ReceiptLatency(time.Since(sentAt))
+		}
+		client.metrics.MessageSent(msg.GetDestination())
+		return nil
+	}
+}
+
+//sendFrame convert the message to SEND frame
+func (client *Client) sendFrame(msg *message.Message) *frame.Frame {
+	frm := frame.NewFrame(frame.SEND, msg.GetBody())
 	frm.Headers[message.Destination] = msg.GetDestination()
 	frm.Headers[message.ContentLength] = strconv.Itoa(len(msg.GetBody()))
-	frm.Headers[message.ContentType] = "text/plain"
 
 	for k, v := range msg.GetHeaders() {
 		frm.Headers[k] = v
 	}
 
-	msgId := msg.GetID()
-	if msgId != "" {
-		frm.Headers[message.MessageId] = msgId
+	//content type set by user or codec is preserved
+	if frm.Headers[message.ContentType] == "" {
+		frm.Headers[message.ContentType] = "text/plain"
+	}
+
+	frm.Headers[message.Destination] = client.dialect.SendDestination(msg.GetDestination(), frm.Headers)
+	frm.Headers[message.MessageId] = msg.GetID()
+	return frm
+}
+
+//Subscribe send SUBSCRIBE command to the Message Broker
+func (client *Client) Subscribe(subscription *Subscription) error {
+	if subscription.Durable != "" {
+		//the id of a durable subscription must be the same after reconnect
+		subscription.id = subscription.Durable
 	} else {
-		msgId := uuid.New().String()
-		msg.SetID(msgId)
-		frm.Headers[message.MessageId] = msgId
+		subscription.GenerateID()
 	}
+	subscription.ready = make(chan struct{})
+	subscription.err = nil
 
-	if deliveryMode == DELIVERY_SYNC {
-		frm.Headers[message.Receipt] = msgId
-		ReceiptPool[msgId] = make(chan *frame.Frame)
+	frm, err := client.subscribeFrame(subscription)
+	if err != nil {
+		return subscription.fail(err)
 	}
 
-	err := client.sender(frm)
+	window, err := newFlowWindow(subscription)
 	if err != nil {
-		return err
+		return subscription.fail(err)
+	}
+	groups, err := newGroupRouter(subscription)
+	if err != nil {
+		return subscription.fail(err)
 	}
 
-	if deliveryMode == DELIVERY_SYNC {
-		_, ok := <-ReceiptPool[msgId]
-		if !ok {
-			return errors.New("ERROR: cannot get receipt  frame from channel")
+	//subscription is registered before SUBSCRIBE is sent, so messages arriving before the receipt are not lost
+	subscription.handler = client.consumeChain(subscription)
+	subscription.window = window
+	subscription.groups = groups
+	if subscription.Ack == ACK_CLIENT || subscription.Ack == ACK_CLIENT_INDIVIDUAL {
+		subscription.tracker = newAckTracker()
+	}
+	client.addSubscriptions(subscription)
+
+	var waiter chan *frame.Frame
+	receiptId := "subscribe-" + subscription.GetID()
+	if subscription.Receipt {
+		frm.Headers[message.Receipt] = receiptId
+		waiter = client.expectReceipt(receiptId)
+	}
+
+	err = client.sender(frm)
+	if waiter != nil {
+		if err != nil {
+			client.cancelReceipt(receiptId)
+		} else {
+			err = client.awaitReceipt(receiptId, waiter)
 		}
-		close(ReceiptPool[msgId])
 	}
+	if err != nil {
+		client.removeSubscription(subscription.GetID())
+		client.logger.Error("cannot subscribe", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+		return subscription.fail(err)
+	}
+
+	close(subscription.ready)
+	if subscription.batchAcks() && subscription.AckBatchInterval > 0 {
+		go client.flushAcksLoop(subscription)
+	}
+	client.logger.Debug("subscribed", subscriptionAttrs(subscription)...)
 	return nil
 }
 
-//Subscribe send SUBSCRIBE command to the Message Broker
-func (client *Client) Subscribe(subscription *Subscription) error {
-	subscription.GenerateID()
+//UnsubscribeWithReceipt send UNSUBSCRIBE and wait until the broker confirms it or rejects it with ERROR
+func (client *Client) UnsubscribeWithReceipt(subscriptionId string) error {
+	frm := frame.NewFrame(frame.UNSUBSCRIBE, []byte(""))
+	frm.Headers[message.Id] = subscriptionId
 
-	frm := frame.NewFrame(frame.SUBSCRIBE, []byte(""))
-	frm.Headers[message.Destination] = subscription.Destination
-	frm.Headers[message.Id] = subscription.GetID()
+	receiptId := "unsubscribe-" + subscriptionId
+	frm.Headers[message.Receipt] = receiptId
+	waiter := client.expectReceipt(receiptId)
 
-	if subscription.Ack == "" {
-		frm.Headers[message.Ack] = ACK_AUTO
+	err := client.sender(frm)
+	if err != nil {
+		client.cancelReceipt(receiptId)
 	} else {
-		frm.Headers[message.Ack] = subscription.Ack
+		err = client.awaitReceipt(receiptId, waiter)
 	}
-
-	err := client.sender(frm)
 	if err != nil {
-		println("Error: " + err.Error())
-		return errors.New("Cannot subscribe to " + subscription.Destination + ". Reason: " + err.Error())
+		client.logger.Error("cannot unsubscribe", slog.String("subscription", subscriptionId), slog.Any("error", err))
+		return errors.New("Cannot unsubscribe " + subscriptionId + ". Reason: " + err.Error())
 	}
 
-	addSubscriptions(subscription)
+	client.removeSubscription(subscriptionId)
 	return nil
 }
 
@@ -266,78 +573,163 @@ func (client *Client) Unsubscribe(subscriptionId string) {
 
 	err := client.sender(frm)
 	if err != nil {
-		println("Error: " + err.Error())
+		client.logger.Error("cannot unsubscribe", slog.String("subscription", subscriptionId), slog.Any("error", err))
 	}
 
-	removeSubscription(subscriptionId)
+	client.removeSubscription(subscriptionId)
 }
 
+//RemoveDurableSubscription permanently delete the durable subscription with the name on the broker.
+//Unsubscribe only detaches from a durable subscription and the broker keeps collecting messages for it.
+func (client *Client) RemoveDurableSubscription(name string) error {
+	frm := frame.NewFrame(frame.UNSUBSCRIBE, []byte(""))
+	frm.Headers[message.Id] = name
+
+	err := client.dialect.RemoveDurable(frm.Headers, name)
+	if err != nil {
+		return err
+	}
+
+	err = client.sender(frm)
+	if err != nil {
+		client.logger.Error("cannot remove durable subscription", slog.String("subscription", name), slog.Any("error", err))
+		return errors.New("Cannot remove durable subscription " + name + ". Reason: " + err.Error())
+	}
+
+	client.removeSubscription(name)
+	return nil
+}
+
+//Ack acknowledge the message.
+//For ACK_CLIENT subscriptions with AckBatchSize or AckBatchInterval the message is only marked as processed
+//and a cumulative ACK is sent for the batch.
 func (client *Client) Ack(msg *message.Message) {
-	frm := frame.NewFrame(frame.ACK, []byte(""))
 	ackId, err := msg.GetHeader(message.Ack)
 	if err != nil {
+		client.logger.Warn("message has no ack header", slog.String("message-id", msg.GetID()))
 		return
-	} else {
-		frm.Headers[message.Id] = ackId
 	}
 
-	err = client.sender(frm)
-	if err != nil {
-		println("Error: " + err.Error())
+	subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+	if subscription != nil && subscription.batchAcks() {
+		processed := subscription.tracker.markProcessed(ackId)
+		if subscription.AckBatchSize > 0 && processed >= subscription.AckBatchSize {
+			err = client.FlushAcks(subscription)
+			if err != nil {
+				client.logger.Error("cannot send batched ACK", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+			}
+		}
+		return
 	}
 
+	err = client.sendAck(frame.ACK, ackId, subscription)
+	if err != nil {
+		client.logger.Error("cannot send ACK", slog.String("message-id", msg.GetID()), slog.Any("error", err))
+	}
 }
 
 func (client *Client) NAck(msg *message.Message) {
-	frm := frame.NewFrame(frame.NACK, []byte(""))
 	ackId, err := msg.GetHeader(message.Ack)
 	if err != nil {
+		client.logger.Warn("message has no ack header", slog.String("message-id", msg.GetID()))
 		return
-	} else {
-		frm.Headers[message.Id] = ackId
 	}
 
-	err = client.sender(frm)
+	subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+	err = client.sendAck(frame.NACK, ackId, subscription)
 	if err != nil {
-		println("Error: " + err.Error())
+		client.logger.Error("cannot send NACK", slog.String("message-id", msg.GetID()), slog.Any("error", err))
 	}
 }
 
-func (client *Client) sender(frm *frame.Frame) error {
+//sender write the frames to the socket with a single flush
+func (client *Client) sender(frames ...*frame.Frame) error {
+	switch client.State() {
+	case StateDisconnecting:
+		if len(frames) != 1 || frames[0].Command != frame.DISCONNECT {
+			return ErrDisconnecting
+		}
+	case StateClosed:
+		return ErrNotConnected
+	}
+
+	//frames written by concurrent callbacks must not interleave
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
 
-	if frm.Command != frame.DISCONNECT && client.connection.tryDisconnect {
-		return errors.New("Disconnect in progress. Clients MUST NOT send any more frames after the DISCONNECT frame is sent.")
+	bufferSize := 4096
+	if len(frames) > 1 {
+		//batches are written with fewer system calls
+		bufferSize = 64 * 1024
 	}
+	writer := NewWriter(client.connection.conn, bufferSize)
+	sizes := make([]int, len(frames))
+	for i, frm := range frames {
+		client.traceFrame("TX", frm)
 
-	writer := NewWriter(client.connection.conn, 4096)
-	err := writer.Write(frm)
+		before := writer.bytesQueued()
+		err := writer.WriteBuffered(frm)
+		if err != nil {
+			return err
+		}
+		sizes[i] = int(writer.bytesQueued() - before)
+	}
+	err := writer.Flush()
 	if err != nil {
 		return err
 	}
+
+	client.lastSent.Store(time.Now().UnixNano())
+	for i, frm := range frames {
+		client.metrics.FrameSent(frm.Command, sizes[i])
+	}
 	return nil
 }
 
-func (client *Client) readerLoop(reader *Reader) {
+func (client *Client) readerLoop(reader *Reader, inbox *inbox, done chan struct{}) {
+	defer close(done)
+	defer inbox.close()
 
 	for {
+		client.awaitReading(inbox)
+		bytesBefore := reader.BytesRead()
 		frm, err := reader.Read()
+		client.lastReceived.Store(time.Now().UnixNano())
 		if err != nil {
-			client.Errors <- err
+			client.failReceipts()
+			if state := client.State(); state == StateDisconnecting || state == StateClosed {
+				client.logger.Debug("connection closed")
+				return
+			}
+			client.logger.Error("cannot read frame", slog.Any("error", err))
+			client.reportError(err)
+			client.connectionLost(err)
 			return
 		}
 		if frm == nil {
 			//heart-beat
 			continue
 		}
+		client.traceFrame("RX", frm)
+		client.metrics.FrameReceived(frm.Command, int(reader.BytesRead()-bytesBefore))
 
 		switch frm.Command {
 		case frame.MESSAGE:
-			transferFrameToSubscriptions(frm)
+			inbox.push(frm)
 			break
 		case frame.RECEIPT:
-			ReceiptPool[frm.Headers[message.ReceiptId]] <- frm
+			client.resolveReceipt(frm)
 			break
 		case frame.ERROR:
+			//ERROR frame related to a frame with receipt is returned to the waiting caller
+			if client.resolveReceipt(frm) {
+				break
+			}
+			client.logger.Error("broker sent ERROR frame",
+				slog.String("message", frm.Headers[message.Message_]),
+				slog.String("receipt-id", frm.Headers[message.ReceiptId]),
+			)
+			client.reportError(newBrokerError(frm))
 			break
 		}
 
@@ -0,0 +1,229 @@
+package gostomp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+//DefaultMaxDecompressedSize is the largest body in bytes a received message is decompressed to
+const DefaultMaxDecompressedSize = 64 << 20
+
+//ErrBodyTooLarge is returned by Compressor.Decompress when the body exceeds the limit
+var ErrBodyTooLarge = errors.New("decompressed body exceeds the limit")
+
+//Compressor compresses message bodies, Encoding is the value of content-encoding header
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	//Decompress must stop with ErrBodyTooLarge as soon as the body exceeds limit bytes,
+	//a small compressed message must not exhaust the memory of the consumer
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+//CompressionConfig describes when and how bodies are compressed on send
+type CompressionConfig struct {
+	//Compressor is used for sending, nil disables compression
+	Compressor Compressor
+	//Threshold is the minimal body size in bytes to compress, smaller bodies are sent as is
+	Threshold int
+}
+
+//Gzip compresses bodies with compress/gzip using the default level
+var Gzip Compressor = gzipCompressor{}
+
+var (
+	compressors      = make(map[string]Compressor)
+	compressorsMutex sync.RWMutex
+)
+
+func init() {
+	RegisterCompressor(Gzip)
+}
+
+//RegisterCompressor make compressor available for decompression of received messages
+func RegisterCompressor(compressor Compressor) {
+	compressorsMutex.Lock()
+	defer compressorsMutex.Unlock()
+
+	compressors[compressor.Encoding()] = compressor
+}
+
+func compressorFor(encoding string) (Compressor, bool) {
+	compressorsMutex.RLock()
+	defer compressorsMutex.RUnlock()
+
+	compressor, ok := compressors[encoding]
+	return compressor, ok
+}
+
+//WithCompression compress bodies of messages for all destinations according to config.
+//The compressor is registered for decompression as well.
+func WithCompression(config CompressionConfig) ClientOption {
+	return func(client *Client) {
+		if config.Compressor != nil {
+			RegisterCompressor(config.Compressor)
+		}
+		client.compression = &config
+	}
+}
+
+//WithMaxDecompressedSize set the largest body in bytes a received message is decompressed to,
+//DefaultMaxDecompressedSize if not set. Larger messages are rejected like messages in an unknown encoding.
+func WithMaxDecompressedSize(size int) ClientOption {
+	return func(client *Client) {
+		client.maxDecompressedSize = size
+	}
+}
+
+//WithDestinationCompression override compression settings for a single destination.
+//Pass CompressionConfig{} to send messages to the destination uncompressed.
+func WithDestinationCompression(destination string, config CompressionConfig) ClientOption {
+	return func(client *Client) {
+		if config.Compressor != nil {
+			RegisterCompressor(config.Compressor)
+		}
+		if client.destinationCompression == nil {
+			client.destinationCompression = make(map[string]CompressionConfig)
+		}
+		client.destinationCompression[destination] = config
+	}
+}
+
+//compressionFor returns compression settings of the destination
+func (client *Client) compressionFor(destination string) (CompressionConfig, bool) {
+	if config, ok := client.destinationCompression[destination]; ok {
+		return config, config.Compressor != nil
+	}
+	if client.compression != nil {
+		return *client.compression, client.compression.Compressor != nil
+	}
+	return CompressionConfig{}, false
+}
+
+//compressMiddleware send a compressed copy of the message when its body is over the threshold
+func (client *Client) compressMiddleware(next SendFunc) SendFunc {
+	return func(msg *message.Message, deliveryMode bool) error {
+		config, ok := client.compressionFor(msg.GetDestination())
+		if !ok || len(msg.GetBody()) < config.Threshold || msg.GetHeaders()[message.ContentEncoding] != "" {
+			return next(msg, deliveryMode)
+		}
+
+		body, err := config.Compressor.Compress(msg.GetBody())
+		if err != nil {
+			return errors.New("Cannot compress message body. Reason: " + err.Error())
+		}
+
+		//the message of the caller is left untouched, so it can be sent again
+		compressed := copyMessage(msg, body)
+		compressed.SetHeader(message.ContentEncoding, config.Compressor.Encoding())
+		return next(compressed, deliveryMode)
+	}
+}
+
+//decompressMiddleware restore the body of received messages with a registered content-encoding,
+//messages in other encodings are rejected
+func (client *Client) decompressMiddleware(next SubscriptionCallback) SubscriptionCallback {
+	return func(msg *message.Message) {
+		encoding := msg.GetHeaders()[message.ContentEncoding]
+		if encoding == "" || encoding == "identity" {
+			next(msg)
+			return
+		}
+
+		//the callback cannot read a body in an unknown encoding
+		compressor, ok := compressorFor(encoding)
+		if !ok {
+			client.logger.Error("unsupported content-encoding of message body",
+				slog.String("message-id", msg.GetID()),
+				slog.String("content-encoding", encoding),
+			)
+			client.reject(msg)
+			return
+		}
+
+		body, err := compressor.Decompress(msg.GetBody(), client.maxDecompressedSize)
+		if err != nil {
+			client.logger.Error("cannot decompress message body",
+				slog.String("message-id", msg.GetID()),
+				slog.String("content-encoding", encoding),
+				slog.Any("error", err),
+			)
+			client.reject(msg)
+			return
+		}
+
+		msg.SetBody(body)
+		delete(msg.GetHeaders(), message.ContentEncoding)
+		msg.SetHeader(message.ContentLength, strconv.Itoa(len(body)))
+		next(msg)
+	}
+}
+
+//reject NACK a message which cannot be handed to the callback.
+//In auto ack mode the broker does not expect NACK, so the message is just dropped.
+func (client *Client) reject(msg *message.Message) {
+	subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+	if subscription == nil || subscription.Ack == "" || subscription.Ack == ACK_AUTO {
+		return
+	}
+	client.NAck(msg)
+}
+
+//copyMessage returns a message with the headers and context of msg and the new body.
+//Unlike msg.Clone the body of msg is not copied, which matters for large payloads.
+func copyMessage(msg *message.Message, body []byte) *message.Message {
+	cp := message.New(body)
+	for key, value := range msg.GetHeaders() {
+		cp.SetHeader(key, value)
+	}
+	cp.SetContext(msg.Context())
+	return cp
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ReadLimited(reader, limit)
+}
+
+//ReadLimited read r to the end, it fails with ErrBodyTooLarge after limit bytes.
+//Compressor implementations use it to bound the decompressed body.
+func ReadLimited(r io.Reader, limit int) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
@@ -0,0 +1,75 @@
+//Package compression provides zstd and snappy compressors for gostomp.
+//Importing the package registers both for decompression of received messages.
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/msidorenko/gostomp"
+)
+
+//Zstd compresses bodies with zstandard using the default level
+var Zstd gostomp.Compressor = zstdCompressor{}
+
+//Snappy compresses bodies with snappy block format
+var Snappy gostomp.Compressor = snappyCompressor{}
+
+//zstdEncoder is shared by all messages, EncodeAll is safe for concurrent use
+var zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+
+func init() {
+	gostomp.RegisterCompressor(Zstd)
+	gostomp.RegisterCompressor(Snappy)
+}
+
+type zstdCompressor struct{}
+
+func (zstdCompressor) Encoding() string {
+	return "zstd"
+}
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if zstdEncoderErr != nil {
+		return nil, errors.New("Cannot create zstd encoder. Reason: " + zstdEncoderErr.Error())
+	}
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+//Decompress stream the body, so decoding stops at the limit, a window larger than the limit is rejected
+func (zstdCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	decoder, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)+1))
+	if err != nil {
+		return nil, errors.New("Cannot create zstd decoder. Reason: " + err.Error())
+	}
+	defer decoder.Close()
+
+	body, err := gostomp.ReadLimited(decoder, limit)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, gostomp.ErrBodyTooLarge
+	}
+	return body, err
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Encoding() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+//Decompress check the length stored in the block before allocating the body
+func (snappyCompressor) Decompress(data []byte, limit int) ([]byte, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if size > limit {
+		return nil, gostomp.ErrBodyTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
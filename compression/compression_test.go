@@ -0,0 +1,54 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"github.com/msidorenko/gostomp"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("order "), 1000)
+
+	for _, compressor := range []gostomp.Compressor{Zstd, Snappy} {
+		compressed, err := compressor.Compress(body)
+		if err != nil {
+			t.Fatalf("%s: %v", compressor.Encoding(), err)
+		}
+		if len(compressed) >= len(body) {
+			t.Fatalf("%s: body is not compressed", compressor.Encoding())
+		}
+
+		decompressed, err := compressor.Decompress(compressed, len(body))
+		if err != nil {
+			t.Fatalf("%s: %v", compressor.Encoding(), err)
+		}
+		if !bytes.Equal(decompressed, body) {
+			t.Fatalf("%s: body differs after decompression", compressor.Encoding())
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	body := make([]byte, 1<<20)
+
+	for _, compressor := range []gostomp.Compressor{Zstd, Snappy} {
+		compressed, err := compressor.Compress(body)
+		if err != nil {
+			t.Fatalf("%s: %v", compressor.Encoding(), err)
+		}
+		_, err = compressor.Decompress(compressed, len(body)-1)
+		if !errors.Is(err, gostomp.ErrBodyTooLarge) {
+			t.Fatalf("%s: expected ErrBodyTooLarge, got %v", compressor.Encoding(), err)
+		}
+	}
+}
+
+func TestDecompressBrokenBody(t *testing.T) {
+	for _, compressor := range []gostomp.Compressor{Zstd, Snappy} {
+		_, err := compressor.Decompress([]byte("not compressed"), 1024)
+		if err == nil {
+			t.Fatalf("%s: broken body is decompressed", compressor.Encoding())
+		}
+	}
+}
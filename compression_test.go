@@ -0,0 +1,169 @@
+package gostomp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+//sendCompressed returns the message compressMiddleware hands to the next SendFunc
+func sendCompressed(t *testing.T, client *Client, msg *message.Message) *message.Message {
+	t.Helper()
+
+	var sent *message.Message
+	err := client.compressMiddleware(func(msg *message.Message, deliveryMode bool) error {
+		sent = msg
+		return nil
+	})(msg, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+func TestCompressionThresholdAndDestination(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613",
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+		WithCompression(CompressionConfig{Compressor: Gzip, Threshold: 16}),
+		WithDestinationCompression("/queue/small", CompressionConfig{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("order "), 100)
+
+	tests := []struct {
+		name        string
+		destination string
+		body        []byte
+		compressed  bool
+	}{
+		{"over threshold", "/queue/orders", large, true},
+		{"under threshold", "/queue/orders", []byte("order"), false},
+		{"disabled for destination", "/queue/small", large, false},
+	}
+	for _, test := range tests {
+		msg := message.New(test.body)
+		msg.SetDestination(test.destination)
+
+		sent := sendCompressed(t, client, msg)
+		encoding := sent.GetHeaders()[message.ContentEncoding]
+		if !test.compressed {
+			if encoding != "" || !bytes.Equal(sent.GetBody(), test.body) {
+				t.Errorf("%s: body is compressed", test.name)
+			}
+			continue
+		}
+		if encoding != "gzip" {
+			t.Errorf("%s: content-encoding is %q", test.name, encoding)
+			continue
+		}
+		if len(sent.GetBody()) >= len(test.body) {
+			t.Errorf("%s: body of %d bytes is not compressed, got %d bytes", test.name, len(test.body), len(sent.GetBody()))
+		}
+		if _, ok := msg.GetHeaders()[message.ContentEncoding]; ok || !bytes.Equal(msg.GetBody(), test.body) {
+			t.Errorf("%s: message of the caller is changed", test.name)
+		}
+		body, err := Gzip.Decompress(sent.GetBody(), DefaultMaxDecompressedSize)
+		if err != nil || !bytes.Equal(body, test.body) {
+			t.Errorf("%s: body does not decompress to the original, error %v", test.name, err)
+		}
+	}
+}
+
+//receiveCompressed passes a delivery of a client-individual subscription through decompressMiddleware.
+//It returns the message the callback got, nil if the callback was not called.
+func receiveCompressed(t *testing.T, client *Client, encoding string, body []byte) *message.Message {
+	t.Helper()
+
+	msg := newDelivery("1")
+	msg.SetBody(body)
+	msg.SetHeader(message.ContentEncoding, encoding)
+
+	var received *message.Message
+	client.decompressMiddleware(func(msg *message.Message) {
+		received = msg
+	})(msg)
+	return received
+}
+
+func TestDecompressBeforeCallback(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1")
+
+	body := bytes.Repeat([]byte("order "), 100)
+	compressed, err := Gzip.Compress(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := receiveCompressed(t, client, "gzip", compressed)
+	if received == nil || !bytes.Equal(received.GetBody(), body) {
+		t.Fatal("callback did not get the decompressed body")
+	}
+	if _, ok := received.GetHeaders()[message.ContentEncoding]; ok {
+		t.Fatal("content-encoding header is left on the decompressed message")
+	}
+	if frames := conn.frames(); len(frames) != 0 {
+		t.Fatalf("unexpected frames %v", frames)
+	}
+}
+
+func TestDecompressRejects(t *testing.T) {
+	bomb, err := Gzip.Compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"unknown encoding", "br", []byte("order")},
+		{"broken body", "gzip", []byte("not gzip")},
+		{"over the limit", "gzip", bomb},
+	}
+	for _, test := range tests {
+		conn := &recordingConn{}
+		client := newConnectedClient(t, conn)
+		client.maxDecompressedSize = 64 * 1024
+		newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL, "1")
+
+		if received := receiveCompressed(t, client, test.encoding, test.body); received != nil {
+			t.Errorf("%s: callback is called", test.name)
+		}
+		if frames := conn.frames(); !reflect.DeepEqual(frames, []string{"NACK 1"}) {
+			t.Errorf("%s: expected NACK, got %v", test.name, frames)
+		}
+	}
+}
+
+func TestDecompressRejectsWithoutNackInAutoMode(t *testing.T) {
+	conn := &recordingConn{}
+	client := newConnectedClient(t, conn)
+	client.addSubscriptions(&Subscription{id: "sub-1", Destination: "/queue/orders"})
+
+	if received := receiveCompressed(t, client, "br", []byte("order")); received != nil {
+		t.Fatal("callback is called")
+	}
+	if frames := conn.frames(); len(frames) != 0 {
+		t.Fatalf("NACK is sent in auto ack mode: %v", frames)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	body, err := ReadLimited(bytes.NewReader([]byte("order")), 5)
+	if err != nil || string(body) != "order" {
+		t.Fatalf("body at the limit is rejected: %q, %v", body, err)
+	}
+	_, err = ReadLimited(bytes.NewReader([]byte("orders")), 5)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
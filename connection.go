@@ -7,15 +7,17 @@ type Connection struct {
 	sslConfig       SSLConfig
 	protocol        string
 	addr            string
-	login           string
-	password        string
+	credentials     CredentialsProvider
+	clientId        string
 	conn            io.ReadWriteCloser
 	options         ConnectionOptions
 	server          string
 	version         []string
 	heartBeatClient int64
 	heartBeatServer int64
-	tryDisconnect   bool
+	//requested heart-beats are sent in CONNECT, heartBeatClient and heartBeatServer are the negotiated ones
+	requestedHeartBeatClient int64
+	requestedHeartBeatServer int64
 }
 
 type SSLConfig struct {
@@ -0,0 +1,102 @@
+package gostomp
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Credentials is a login and passcode pair sent with the CONNECT frame
+type Credentials struct {
+	Login    string
+	Passcode string
+}
+
+//CredentialsProvider is asked for credentials every time the client (re)connects to the Message Broker,
+//so rotated secrets are picked up without rebuilding the client
+type CredentialsProvider interface {
+	Credentials() (Credentials, error)
+}
+
+//CredentialsProviderFunc is an adapter to allow the use of ordinary functions as CredentialsProvider
+type CredentialsProviderFunc func() (Credentials, error)
+
+func (f CredentialsProviderFunc) Credentials() (Credentials, error) {
+	return f()
+}
+
+type staticCredentials struct {
+	credentials Credentials
+}
+
+//StaticCredentials always returns the same login and passcode
+func StaticCredentials(login, passcode string) CredentialsProvider {
+	return &staticCredentials{credentials: Credentials{Login: login, Passcode: passcode}}
+}
+
+func (p *staticCredentials) Credentials() (Credentials, error) {
+	return p.credentials, nil
+}
+
+type envCredentials struct {
+	loginVar    string
+	passcodeVar string
+}
+
+//EnvCredentials reads login and passcode from the environment variables on every call
+func EnvCredentials(loginVar, passcodeVar string) CredentialsProvider {
+	return &envCredentials{loginVar: loginVar, passcodeVar: passcodeVar}
+}
+
+func (p *envCredentials) Credentials() (Credentials, error) {
+	login, ok := os.LookupEnv(p.loginVar)
+	if !ok {
+		return Credentials{}, errors.New("environment variable " + p.loginVar + " is not set")
+	}
+	return Credentials{Login: login, Passcode: os.Getenv(p.passcodeVar)}, nil
+}
+
+type fileCredentials struct {
+	path        string
+	mutex       sync.Mutex
+	modTime     time.Time
+	size        int64
+	credentials Credentials
+}
+
+//FileCredentials reads credentials from a file in "login:passcode" format.
+//The file is re-read only when its modification time or size has changed.
+func FileCredentials(path string) CredentialsProvider {
+	return &fileCredentials{path: path}
+}
+
+func (p *fileCredentials) Credentials() (Credentials, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.credentials, nil
+	}
+
+	content, err := os.ReadFile(p.path)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	login, passcode, found := strings.Cut(strings.TrimSpace(string(content)), ":")
+	if !found {
+		return Credentials{}, errors.New("credentials file " + p.path + " must be in login:passcode format")
+	}
+
+	p.credentials = Credentials{Login: login, Passcode: passcode}
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	return p.credentials, nil
+}
@@ -0,0 +1,389 @@
+package gostomp
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DedupStore remembers keys of processed messages
+type DedupStore interface {
+	//Contains reports whether the key was added and has not expired yet
+	Contains(key string) (bool, error)
+	Add(key string) error
+}
+
+//DedupConfig describes how duplicates are recognized
+type DedupConfig struct {
+	Store DedupStore
+	//Header holds the deduplication key, message-id if empty
+	Header string
+}
+
+//WithDeduplication skip duplicates of already processed messages in all subscriptions, see Client.Deduplicate
+func WithDeduplication(config DedupConfig) ClientOption {
+	return func(client *Client) {
+		client.consumeMiddleware = append(client.consumeMiddleware, client.Deduplicate(config))
+	}
+}
+
+//Deduplicate returns ConsumeMiddleware which does not call the callback for messages whose key is in the store.
+//Duplicates of ACK_CLIENT and ACK_CLIENT_INDIVIDUAL subscriptions are acknowledged.
+//The key is added to the store when the message is acknowledged, in auto ack mode after the callback returns.
+//A message which is NACKed or not acknowledged before reconnect is processed again when the broker redelivers it.
+//While a delivery of the key is not settled, other deliveries of the key wait for it.
+//Messages without the key header are passed through.
+//If the store fails the message is passed to the callback, a duplicate is preferred over a lost message.
+func (client *Client) Deduplicate(config DedupConfig) ConsumeMiddleware {
+	header := config.Header
+	if header == "" {
+		header = message.MessageId
+	}
+	reservations := &dedupReservations{keys: make(map[string]chan struct{})}
+
+	add := func(key string) {
+		err := config.Store.Add(key)
+		if err != nil {
+			client.logger.Error("cannot add key to deduplication store", slog.String("key", key), slog.Any("error", err))
+		}
+	}
+
+	return func(next SubscriptionCallback) SubscriptionCallback {
+		return func(msg *message.Message) {
+			key := msg.GetHeaders()[header]
+			if key == "" {
+				next(msg)
+				return
+			}
+
+			release := reservations.reserve(key)
+			seen, err := config.Store.Contains(key)
+			if err != nil {
+				client.logger.Error("cannot check deduplication store", slog.String("key", key), slog.Any("error", err))
+			}
+			if seen {
+				release()
+				client.logger.Debug("duplicate message skipped", slog.String("message-id", msg.GetID()), slog.String("key", key))
+				client.acknowledge(msg)
+				return
+			}
+
+			subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+			if subscription == nil || subscription.tracker == nil {
+				next(msg)
+				add(key)
+				release()
+				return
+			}
+
+			registered := subscription.tracker.onSettled(msg.GetHeaders()[message.Ack], func(acked bool) {
+				if acked {
+					add(key)
+				}
+				release()
+			})
+			if !registered {
+				//the ack id is not valid anymore after reconnect, the broker redelivers the message
+				release()
+			}
+			next(msg)
+		}
+	}
+}
+
+//dedupReservations keeps keys of deliveries which are not settled yet
+type dedupReservations struct {
+	mutex sync.Mutex
+	//keys are closed when the delivery is settled
+	keys map[string]chan struct{}
+}
+
+//reserve wait until no other delivery of the key is in flight and reserve the key until release is called
+func (reservations *dedupReservations) reserve(key string) (release func()) {
+	for {
+		reservations.mutex.Lock()
+		pending, ok := reservations.keys[key]
+		if !ok {
+			settled := make(chan struct{})
+			reservations.keys[key] = settled
+			reservations.mutex.Unlock()
+
+			return func() {
+				reservations.mutex.Lock()
+				delete(reservations.keys, key)
+				reservations.mutex.Unlock()
+				close(settled)
+			}
+		}
+		reservations.mutex.Unlock()
+		<-pending
+	}
+}
+
+//acknowledge ACK a message which is not handed to the callback.
+//In auto ack mode the broker does not expect ACK.
+func (client *Client) acknowledge(msg *message.Message) {
+	subscription := client.subscriptionByID(msg.GetHeaders()[message.Subscription])
+	if subscription == nil || subscription.Ack == "" || subscription.Ack == ACK_AUTO {
+		return
+	}
+	client.Ack(msg)
+}
+
+//MemoryDedupStore keeps keys in memory for ttl, the least recently added keys are evicted over capacity
+type MemoryDedupStore struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	capacity int
+	keys     map[string]*list.Element
+	//order holds dedupEntry values, the most recently added at the front
+	order *list.List
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+//NewMemoryDedupStore create store, zero ttl keeps keys until they are evicted, zero capacity is unlimited
+func NewMemoryDedupStore(ttl time.Duration, capacity int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		ttl:      ttl,
+		capacity: capacity,
+		keys:     make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (store *MemoryDedupStore) Contains(key string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	element, ok := store.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if store.expired(element.Value.(*dedupEntry), time.Now()) {
+		store.remove(element)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (store *MemoryDedupStore) Add(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	entry := &dedupEntry{key: key}
+	if store.ttl > 0 {
+		entry.expires = now.Add(store.ttl)
+	}
+
+	if element, ok := store.keys[key]; ok {
+		element.Value = entry
+		store.order.MoveToFront(element)
+	} else {
+		store.keys[key] = store.order.PushFront(entry)
+	}
+
+	//the oldest keys are at the back, expired ones are dropped on the way
+	for element := store.order.Back(); element != nil; element = store.order.Back() {
+		overCapacity := store.capacity > 0 && store.order.Len() > store.capacity
+		if !overCapacity && !store.expired(element.Value.(*dedupEntry), now) {
+			break
+		}
+		store.remove(element)
+	}
+	return nil
+}
+
+//Len returns the number of stored keys including expired ones which were not evicted yet
+func (store *MemoryDedupStore) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.order.Len()
+}
+
+func (store *MemoryDedupStore) expired(entry *dedupEntry, now time.Time) bool {
+	return !entry.expires.IsZero() && now.After(entry.expires)
+}
+
+func (store *MemoryDedupStore) remove(element *list.Element) {
+	store.order.Remove(element)
+	delete(store.keys, element.Value.(*dedupEntry).key)
+}
+
+//FileDedupStore keeps keys in memory and appends them to a file, so they survive restarts.
+//The file is compacted when it is opened and when expired lines outnumber live keys.
+type FileDedupStore struct {
+	mutex sync.Mutex
+	path  string
+	ttl   time.Duration
+	file  *os.File
+	//keys maps keys to expiration in unix milliseconds, 0 never expires
+	keys  map[string]int64
+	lines int
+}
+
+//NewFileDedupStore open or create the store file, zero ttl keeps keys forever
+func NewFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	store := &FileDedupStore{
+		path: path,
+		ttl:  ttl,
+		keys: make(map[string]int64),
+	}
+
+	err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	err = store.compact()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *FileDedupStore) Contains(key string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	expires, ok := store.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if expires != 0 && time.Now().UnixMilli() > expires {
+		delete(store.keys, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (store *FileDedupStore) Add(key string) error {
+	if strings.Contains(key, "\n") {
+		return errors.New("deduplication key must not contain new lines")
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.file == nil {
+		return errors.New("deduplication store is closed")
+	}
+
+	var expires int64
+	if store.ttl > 0 {
+		expires = time.Now().Add(store.ttl).UnixMilli()
+	}
+
+	_, err := store.file.WriteString(strconv.FormatInt(expires, 10) + " " + key + "\n")
+	if err != nil {
+		return err
+	}
+	store.keys[key] = expires
+	store.lines++
+
+	if store.lines > 2*len(store.keys)+1024 {
+		store.dropExpired()
+		return store.compact()
+	}
+	return nil
+}
+
+//Close close the store file
+func (store *FileDedupStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	return err
+}
+
+//load read keys which have not expired yet, lines with invalid format are skipped
+func (store *FileDedupStore) load() error {
+	file, err := os.Open(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now().UnixMilli()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		expiresText, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || key == "" {
+			continue
+		}
+		expires, err := strconv.ParseInt(expiresText, 10, 64)
+		if err != nil || (expires != 0 && now > expires) {
+			continue
+		}
+		store.keys[key] = expires
+	}
+	return scanner.Err()
+}
+
+func (store *FileDedupStore) dropExpired() {
+	now := time.Now().UnixMilli()
+	for key, expires := range store.keys {
+		if expires != 0 && now > expires {
+			delete(store.keys, key)
+		}
+	}
+}
+
+//compact rewrite the file with live keys only, the new file replaces the old one atomically
+func (store *FileDedupStore) compact() error {
+	tmp := store.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for key, expires := range store.keys {
+		writer.WriteString(strconv.FormatInt(expires, 10) + " " + key + "\n")
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, store.path)
+	if err != nil {
+		return err
+	}
+
+	if store.file != nil {
+		store.file.Close()
+	}
+	store.file, err = os.OpenFile(store.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	store.lines = len(store.keys)
+	return nil
+}
@@ -0,0 +1,92 @@
+package gostomp
+
+import (
+	"github.com/msidorenko/gostomp/message"
+	"testing"
+	"time"
+)
+
+func newDedupSubscription(t *testing.T, client *Client, store DedupStore, callback SubscriptionCallback) *Subscription {
+	t.Helper()
+
+	subscription := newTrackedSubscription(client, ACK_CLIENT_INDIVIDUAL)
+	subscription.Callback = callback
+	subscription.handler = client.Deduplicate(DedupConfig{Store: store})(callback)
+	return subscription
+}
+
+//redeliver track the delivery as transferFrameToSubscriptions does and returns the message for the handler
+func redeliver(subscription *Subscription, ackId string) *message.Message {
+	msg := newDelivery(ackId)
+	msg.SetHeader(message.MessageId, "order-1")
+	subscription.tracker.delivered(ackId, "order-1")
+	return msg
+}
+
+func TestDeduplicateRecordsKeyOnAck(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	store := NewMemoryDedupStore(0, 0)
+	calls := 0
+	subscription := newDedupSubscription(t, client, store, func(msg *message.Message) {
+		calls++
+	})
+
+	first := redeliver(subscription, "1")
+	subscription.handler(first)
+	if seen, _ := store.Contains("order-1"); seen {
+		t.Fatal("key is stored before the message is acknowledged")
+	}
+	client.NAck(first)
+
+	second := redeliver(subscription, "2")
+	subscription.handler(second)
+	if calls != 2 {
+		t.Fatalf("redelivery of a NACKed message is skipped, callback called %d times", calls)
+	}
+	client.Ack(second)
+	if seen, _ := store.Contains("order-1"); !seen {
+		t.Fatal("key is not stored when the message is acknowledged")
+	}
+
+	subscription.handler(redeliver(subscription, "3"))
+	if calls != 2 {
+		t.Fatal("duplicate of an acknowledged message is handed to the callback")
+	}
+	if unacked := subscription.Unacked(); len(unacked) != 0 {
+		t.Fatalf("duplicate is not acknowledged, unacknowledged messages %v", unacked)
+	}
+}
+
+func TestDeduplicateWaitsForDeliveryInFlight(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	store := NewMemoryDedupStore(0, 0)
+	calls := make(chan *message.Message, 2)
+	subscription := newDedupSubscription(t, client, store, func(msg *message.Message) {
+		calls <- msg
+	})
+
+	first := redeliver(subscription, "1")
+	subscription.handler(first)
+	<-calls
+
+	handled := make(chan struct{})
+	go func() {
+		subscription.handler(redeliver(subscription, "2"))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+		t.Fatal("concurrent redelivery passes while the first delivery is not acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.Ack(first)
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("redelivery is not released by ACK")
+	}
+	if len(calls) != 0 {
+		t.Fatal("duplicate of an acknowledged message is handed to the callback")
+	}
+}
@@ -0,0 +1,439 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Feature is a broker capability which is expressed differently by every broker
+type Feature string
+
+const (
+	FeatureDelay               Feature = "delay"
+	FeatureRecurring           Feature = "recurring delivery"
+	FeatureTTL                 Feature = "ttl"
+	FeaturePriority            Feature = "priority"
+	FeaturePersistent          Feature = "persistent"
+	FeatureDurableSubscription Feature = "durable subscription"
+	FeatureSelector            Feature = "selector"
+	FeaturePrefetch            Feature = "prefetch"
+	FeatureExclusive           Feature = "exclusive consumer"
+	FeatureConsumerPriority    Feature = "consumer priority"
+	//FeatureDuplicateDetection is dropping of messages whose duplicate id the broker has already seen
+	FeatureDuplicateDetection Feature = "duplicate detection"
+)
+
+//ErrUnsupportedFeature is matched by errors.Is for all UnsupportedFeatureError values
+var ErrUnsupportedFeature = errors.New("feature is not supported by the broker")
+
+//UnsupportedFeatureError is returned by Dialect when the broker has no way to express the feature
+type UnsupportedFeatureError struct {
+	Dialect string
+	Feature Feature
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	return string(e.Feature) + " is not supported by " + e.Dialect
+}
+
+func (e *UnsupportedFeatureError) Is(target error) bool {
+	return target == ErrUnsupportedFeature
+}
+
+//Dialect maps generic features onto broker specific headers and destination syntax.
+//Generic destinations are /queue/<name> and /topic/<name>.
+type Dialect interface {
+	Name() string
+	Supports(feature Feature) bool
+
+	//SendDestination translate destination of a SEND frame, routing headers may be added to headers
+	SendDestination(destination string, headers map[string]string) string
+	//SubscribeDestination translate destination of a SUBSCRIBE frame, routing headers may be added to headers
+	SubscribeDestination(destination string, headers map[string]string) string
+
+	SetDelay(msg *message.Message, delay time.Duration) error
+	//SetDeliveryTime ask the broker to hold the message until the time
+	SetDeliveryTime(msg *message.Message, at time.Time) error
+	//SetSchedule ask the broker to deliver the message repeatedly
+	SetSchedule(msg *message.Message, schedule Schedule) error
+	SetTTL(msg *message.Message, ttl time.Duration) error
+	SetPriority(msg *message.Message, priority int) error
+	SetPersistent(msg *message.Message, persistent bool) error
+	//SetDuplicateId set the id the broker detects duplicates by, an id set before is kept
+	SetDuplicateId(msg *message.Message, id string) error
+
+	//SetDurable add headers of a durable subscription with the name to SUBSCRIBE headers
+	SetDurable(headers map[string]string, name string) error
+	//RemoveDurable add headers to UNSUBSCRIBE which permanently remove the durable subscription
+	RemoveDurable(headers map[string]string, name string) error
+	SetSelector(headers map[string]string, selector string) error
+	SetPrefetch(headers map[string]string, prefetch int) error
+	SetExclusive(headers map[string]string) error
+	SetConsumerPriority(headers map[string]string, priority int) error
+}
+
+var (
+	//Generic uses only headers defined by the STOMP specification, all features are unsupported
+	Generic Dialect = &brokerDialect{name: "generic STOMP"}
+
+	//ActiveMQ is ActiveMQ Classic
+	ActiveMQ Dialect = &brokerDialect{
+		name:           "ActiveMQ",
+		delayHeader:    message.Delay,
+		recurring:      true,
+		ttlHeader:      message.Expires,
+		ttlAbsolute:    true,
+		priority:       true,
+		maxPriority:    9,
+		persistent:     true,
+		durableHeader:  "activemq.subscriptionName",
+		selectorHeader: "selector",
+		prefetchHeader: "activemq.prefetchSize",
+
+		exclusiveHeader:        "activemq.exclusive",
+		consumerPriorityHeader: "activemq.priority",
+		maxConsumerPriority:    127,
+	}
+
+	//Artemis is ActiveMQ Artemis, /queue/ and /topic/ prefixes are replaced by routing type headers.
+	//Its consumer window is counted in bytes, so Prefetch is the number of bytes of messages sent ahead.
+	Artemis Dialect = &brokerDialect{
+		name:              "ActiveMQ Artemis",
+		delayHeader:       "_AMQ_SCHED_DELIVERY",
+		delayAbsolute:     true,
+		ttlHeader:         message.Expires,
+		ttlAbsolute:       true,
+		priority:          true,
+		maxPriority:       9,
+		persistent:        true,
+		durableHeader:     "durable-subscription-name",
+		selectorHeader:    "selector",
+		prefetchHeader:    "consumer-window-size",
+		duplicateIdHeader: "_AMQ_DUPL_ID",
+		routingTypeHeader: true,
+	}
+
+	//RabbitMQ with the STOMP plugin, delay requires the delayed message exchange plugin
+	RabbitMQ Dialect = &brokerDialect{
+		name:           "RabbitMQ",
+		delayHeader:    "x-delay",
+		ttlHeader:      message.Expiration,
+		priority:       true,
+		maxPriority:    255,
+		persistent:     true,
+		rabbitDurable:  true,
+		prefetchHeader: "prefetch-count",
+
+		exclusiveHeader:        "exclusive",
+		consumerPriorityHeader: "x-priority",
+		maxConsumerPriority:    255,
+	}
+)
+
+//DialectByName returns dialect for activemq, artemis, rabbitmq or generic
+func DialectByName(name string) (Dialect, error) {
+	switch strings.ToLower(name) {
+	case "", "generic", "stomp":
+		return Generic, nil
+	case "activemq", "amq":
+		return ActiveMQ, nil
+	case "artemis":
+		return Artemis, nil
+	case "rabbitmq", "rabbit":
+		return RabbitMQ, nil
+	}
+	return nil, errors.New("unknown broker dialect '" + name + "'")
+}
+
+//WithDialect select the broker dialect, it can also be set by "dialect" DSN query parameter
+func WithDialect(dialect Dialect) ClientOption {
+	return func(client *Client) {
+		client.dialect = dialect
+	}
+}
+
+//Dialect returns the broker dialect of the client, Generic if none was selected
+func (client *Client) Dialect() Dialect {
+	return client.dialect
+}
+
+//RabbitExchange returns RabbitMQ destination which sends to the exchange with the routing key
+func RabbitExchange(exchange, routingKey string) string {
+	if routingKey == "" {
+		return "/exchange/" + exchange
+	}
+	return "/exchange/" + exchange + "/" + routingKey
+}
+
+//RabbitAmqQueue returns RabbitMQ destination of a queue created outside of the STOMP plugin
+func RabbitAmqQueue(queue string) string {
+	return "/amq/queue/" + queue
+}
+
+type brokerDialect struct {
+	name string
+
+	//delayHeader carries milliseconds of delay or, if delayAbsolute, the delivery time in milliseconds since epoch
+	delayHeader   string
+	delayAbsolute bool
+	//recurring is ActiveMQ scheduler support of period, repeat and cron headers
+	recurring bool
+	//ttlHeader carries milliseconds of time to live or, if ttlAbsolute, the expiration time in milliseconds since epoch
+	ttlHeader   string
+	ttlAbsolute bool
+
+	priority    bool
+	maxPriority int
+	persistent  bool
+
+	durableHeader  string
+	rabbitDurable  bool
+	selectorHeader string
+	prefetchHeader string
+
+	exclusiveHeader        string
+	consumerPriorityHeader string
+	maxConsumerPriority    int
+
+	//duplicateIdHeader carries the id of broker duplicate detection
+	duplicateIdHeader string
+
+	//routingTypeHeader replaces /queue/ and /topic/ prefixes by Artemis routing type headers
+	routingTypeHeader bool
+}
+
+func (d *brokerDialect) Name() string {
+	return d.name
+}
+
+func (d *brokerDialect) Supports(feature Feature) bool {
+	switch feature {
+	case FeatureDelay:
+		return d.delayHeader != ""
+	case FeatureRecurring:
+		return d.recurring
+	case FeatureTTL:
+		return d.ttlHeader != ""
+	case FeaturePriority:
+		return d.priority
+	case FeaturePersistent:
+		return d.persistent
+	case FeatureDurableSubscription:
+		return d.durableHeader != "" || d.rabbitDurable
+	case FeatureSelector:
+		return d.selectorHeader != ""
+	case FeaturePrefetch:
+		return d.prefetchHeader != ""
+	case FeatureExclusive:
+		return d.exclusiveHeader != ""
+	case FeatureConsumerPriority:
+		return d.consumerPriorityHeader != ""
+	case FeatureDuplicateDetection:
+		return d.duplicateIdHeader != ""
+	}
+	return false
+}
+
+func (d *brokerDialect) unsupported(feature Feature) error {
+	return &UnsupportedFeatureError{Dialect: d.name, Feature: feature}
+}
+
+func (d *brokerDialect) SendDestination(destination string, headers map[string]string) string {
+	return d.routeDestination(destination, headers, "destination-type")
+}
+
+func (d *brokerDialect) SubscribeDestination(destination string, headers map[string]string) string {
+	return d.routeDestination(destination, headers, "subscription-type")
+}
+
+func (d *brokerDialect) routeDestination(destination string, headers map[string]string, routingHeader string) string {
+	if !d.routingTypeHeader {
+		return destination
+	}
+
+	switch {
+	case strings.HasPrefix(destination, "/queue/"):
+		headers[routingHeader] = "ANYCAST"
+		return strings.TrimPrefix(destination, "/queue/")
+	case strings.HasPrefix(destination, "/topic/"):
+		headers[routingHeader] = "MULTICAST"
+		return strings.TrimPrefix(destination, "/topic/")
+	}
+	return destination
+}
+
+func (d *brokerDialect) SetDelay(msg *message.Message, delay time.Duration) error {
+	if !d.Supports(FeatureDelay) {
+		return d.unsupported(FeatureDelay)
+	}
+	if delay < 0 {
+		return errors.New("delay must not be negative")
+	}
+
+	if d.delayAbsolute {
+		msg.SetHeader(d.delayHeader, strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10))
+	} else {
+		msg.SetHeader(d.delayHeader, strconv.FormatInt(delay.Milliseconds(), 10))
+	}
+	return nil
+}
+
+func (d *brokerDialect) SetDeliveryTime(msg *message.Message, at time.Time) error {
+	if !d.Supports(FeatureDelay) {
+		return d.unsupported(FeatureDelay)
+	}
+
+	if d.delayAbsolute {
+		msg.SetHeader(d.delayHeader, strconv.FormatInt(at.UnixMilli(), 10))
+		return nil
+	}
+
+	//relative delay is counted from now, the time it takes to send the message is not compensated
+	delay := time.Until(at)
+	if delay < 0 {
+		delay = 0
+	}
+	msg.SetHeader(d.delayHeader, strconv.FormatInt(delay.Milliseconds(), 10))
+	return nil
+}
+
+func (d *brokerDialect) SetSchedule(msg *message.Message, schedule Schedule) error {
+	if !d.Supports(FeatureRecurring) {
+		return d.unsupported(FeatureRecurring)
+	}
+	err := schedule.validate()
+	if err != nil {
+		return err
+	}
+
+	if schedule.Cron != "" {
+		msg.SetHeader(message.ScheduledCron, schedule.Cron)
+	}
+	if schedule.Delay > 0 {
+		msg.SetHeader(message.Delay, strconv.FormatInt(schedule.Delay.Milliseconds(), 10))
+	}
+	if schedule.Period > 0 {
+		msg.SetHeader(message.ScheduledPeriod, strconv.FormatInt(schedule.Period.Milliseconds(), 10))
+	}
+	if schedule.Repeat > 0 {
+		msg.SetHeader(message.ScheduledRepeat, strconv.Itoa(schedule.Repeat))
+	}
+	return nil
+}
+
+func (d *brokerDialect) SetTTL(msg *message.Message, ttl time.Duration) error {
+	if !d.Supports(FeatureTTL) {
+		return d.unsupported(FeatureTTL)
+	}
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+
+	if d.ttlAbsolute {
+		msg.SetHeader(d.ttlHeader, strconv.FormatInt(time.Now().Add(ttl).UnixMilli(), 10))
+	} else {
+		msg.SetHeader(d.ttlHeader, strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return nil
+}
+
+func (d *brokerDialect) SetPriority(msg *message.Message, priority int) error {
+	if !d.Supports(FeaturePriority) {
+		return d.unsupported(FeaturePriority)
+	}
+	if priority < 0 || priority > d.maxPriority {
+		return errors.New("priority of " + d.name + " must be between 0 and " + strconv.Itoa(d.maxPriority))
+	}
+
+	msg.SetPriority(priority)
+	return nil
+}
+
+func (d *brokerDialect) SetPersistent(msg *message.Message, persistent bool) error {
+	if !d.Supports(FeaturePersistent) {
+		return d.unsupported(FeaturePersistent)
+	}
+
+	msg.SetPersistent(persistent)
+	return nil
+}
+
+func (d *brokerDialect) SetDuplicateId(msg *message.Message, id string) error {
+	if !d.Supports(FeatureDuplicateDetection) {
+		return d.unsupported(FeatureDuplicateDetection)
+	}
+
+	if msg.GetHeaders()[d.duplicateIdHeader] == "" {
+		msg.SetHeader(d.duplicateIdHeader, id)
+	}
+	return nil
+}
+
+func (d *brokerDialect) SetDurable(headers map[string]string, name string) error {
+	if !d.Supports(FeatureDurableSubscription) {
+		return d.unsupported(FeatureDurableSubscription)
+	}
+	if name == "" {
+		return errors.New("durable subscription name must not be empty")
+	}
+
+	if d.rabbitDurable {
+		//RabbitMQ names the queue of a durable subscription after the subscription id,
+		//Client.Subscribe uses the durable name as id
+		headers["durable"] = "true"
+		headers["auto-delete"] = "false"
+		return nil
+	}
+	headers[d.durableHeader] = name
+	return nil
+}
+
+func (d *brokerDialect) RemoveDurable(headers map[string]string, name string) error {
+	//brokers expect the same headers on UNSUBSCRIBE to delete the durable subscription
+	return d.SetDurable(headers, name)
+}
+
+func (d *brokerDialect) SetSelector(headers map[string]string, selector string) error {
+	if !d.Supports(FeatureSelector) {
+		return d.unsupported(FeatureSelector)
+	}
+
+	headers[d.selectorHeader] = selector
+	return nil
+}
+
+func (d *brokerDialect) SetPrefetch(headers map[string]string, prefetch int) error {
+	if !d.Supports(FeaturePrefetch) {
+		return d.unsupported(FeaturePrefetch)
+	}
+	if prefetch <= 0 {
+		return errors.New("prefetch must be positive")
+	}
+
+	headers[d.prefetchHeader] = strconv.Itoa(prefetch)
+	return nil
+}
+
+func (d *brokerDialect) SetExclusive(headers map[string]string) error {
+	if !d.Supports(FeatureExclusive) {
+		return d.unsupported(FeatureExclusive)
+	}
+
+	headers[d.exclusiveHeader] = "true"
+	return nil
+}
+
+func (d *brokerDialect) SetConsumerPriority(headers map[string]string, priority int) error {
+	if !d.Supports(FeatureConsumerPriority) {
+		return d.unsupported(FeatureConsumerPriority)
+	}
+	if priority < 0 || priority > d.maxConsumerPriority {
+		return errors.New("consumer priority of " + d.name + " must be between 0 and " + strconv.Itoa(d.maxConsumerPriority))
+	}
+
+	headers[d.consumerPriorityHeader] = strconv.Itoa(priority)
+	return nil
+}
@@ -0,0 +1,256 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDialectFromDSN(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		expected Dialect
+	}{
+		{"tcp://localhost:61613", Generic},
+		{"tcp://localhost:61613?dialect=generic", Generic},
+		{"tcp://localhost:61613?dialect=activemq", ActiveMQ},
+		{"tcp://localhost:61613?dialect=AMQ", ActiveMQ},
+		{"tcp://localhost:61613?dialect=artemis", Artemis},
+		{"tcp://localhost:61613?dialect=rabbit", RabbitMQ},
+		{"ssl://localhost:61614?insecure=true&dialect=RabbitMQ", RabbitMQ},
+		{"tcp://localhost:61613?dialect=kafka", nil},
+	}
+
+	for _, test := range tests {
+		client, err := NewClient(test.dsn)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: unknown dialect is accepted", test.dsn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.dsn, err)
+			continue
+		}
+		if client.Dialect() != test.expected {
+			t.Errorf("%s: got dialect %s", test.dsn, client.Dialect().Name())
+		}
+	}
+}
+
+func TestDialectMessageHeaders(t *testing.T) {
+	type set func(dialect Dialect, msg *message.Message) error
+	delay := func(dialect Dialect, msg *message.Message) error { return dialect.SetDelay(msg, 30*time.Second) }
+	ttl := func(dialect Dialect, msg *message.Message) error { return dialect.SetTTL(msg, time.Minute) }
+	priority := func(dialect Dialect, msg *message.Message) error { return dialect.SetPriority(msg, 7) }
+	persistent := func(dialect Dialect, msg *message.Message) error { return dialect.SetPersistent(msg, true) }
+	schedule := func(dialect Dialect, msg *message.Message) error {
+		return dialect.SetSchedule(msg, Schedule{Delay: time.Second, Period: time.Minute, Repeat: 3, Cron: "0 * * * *"})
+	}
+	duplicateId := func(dialect Dialect, msg *message.Message) error { return dialect.SetDuplicateId(msg, "d1") }
+
+	//expected header values, "+<ms>" is a time in milliseconds since epoch that far from now, nil means unsupported
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		set      set
+		expected map[string]string
+	}{
+		{"ActiveMQ delay", ActiveMQ, delay, map[string]string{message.Delay: "30000"}},
+		{"Artemis delay", Artemis, delay, map[string]string{"_AMQ_SCHED_DELIVERY": "+30000"}},
+		{"RabbitMQ delay", RabbitMQ, delay, map[string]string{"x-delay": "30000"}},
+		{"generic delay", Generic, delay, nil},
+		{"ActiveMQ ttl", ActiveMQ, ttl, map[string]string{message.Expires: "+60000"}},
+		{"Artemis ttl", Artemis, ttl, map[string]string{message.Expires: "+60000"}},
+		{"RabbitMQ ttl", RabbitMQ, ttl, map[string]string{message.Expiration: "60000"}},
+		{"generic ttl", Generic, ttl, nil},
+		{"ActiveMQ priority", ActiveMQ, priority, map[string]string{message.Priority: "7"}},
+		{"RabbitMQ priority", RabbitMQ, priority, map[string]string{message.Priority: "7"}},
+		{"generic priority", Generic, priority, nil},
+		{"Artemis persistent", Artemis, persistent, map[string]string{message.Persistent: "true"}},
+		{"generic persistent", Generic, persistent, nil},
+		{"ActiveMQ schedule", ActiveMQ, schedule, map[string]string{
+			message.Delay:           "1000",
+			message.ScheduledPeriod: "60000",
+			message.ScheduledRepeat: "3",
+			message.ScheduledCron:   "0 * * * *",
+		}},
+		{"Artemis schedule", Artemis, schedule, nil},
+		{"RabbitMQ schedule", RabbitMQ, schedule, nil},
+		{"Artemis duplicate id", Artemis, duplicateId, map[string]string{"_AMQ_DUPL_ID": "d1"}},
+		{"ActiveMQ duplicate id", ActiveMQ, duplicateId, nil},
+	}
+
+	for _, test := range tests {
+		msg := message.New(nil)
+		err := test.set(test.dialect, msg)
+		if test.expected == nil {
+			if !errors.Is(err, ErrUnsupportedFeature) {
+				t.Errorf("%s: expected ErrUnsupportedFeature, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for key, value := range test.expected {
+			header := msg.GetHeaders()[key]
+			if value[0] != '+' {
+				if header != value {
+					t.Errorf("%s: header %s is %q instead of %q", test.name, key, header, value)
+				}
+				continue
+			}
+			offset, _ := strconv.ParseInt(value[1:], 10, 64)
+			millis, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || time.UnixMilli(millis).Sub(time.Now().Add(time.Duration(offset)*time.Millisecond)).Abs() > 5*time.Second {
+				t.Errorf("%s: header %s is %q, expected about %s from now", test.name, key, header, time.Duration(offset)*time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestDialectRejectsInvalidValues(t *testing.T) {
+	msg := message.New(nil)
+	tests := map[string]error{
+		"negative delay":         ActiveMQ.SetDelay(msg, -time.Second),
+		"zero ttl":               RabbitMQ.SetTTL(msg, 0),
+		"ActiveMQ priority 10":   ActiveMQ.SetPriority(msg, 10),
+		"RabbitMQ priority 256":  RabbitMQ.SetPriority(msg, 256),
+		"repeat without period":  ActiveMQ.SetSchedule(msg, Schedule{Repeat: 2}),
+		"negative prefetch":      ActiveMQ.SetPrefetch(map[string]string{}, -1),
+		"empty durable name":     ActiveMQ.SetDurable(map[string]string{}, ""),
+		"consumer priority 128":  ActiveMQ.SetConsumerPriority(map[string]string{}, 128),
+		"negative consumer prio": RabbitMQ.SetConsumerPriority(map[string]string{}, -1),
+	}
+	for name, err := range tests {
+		if err == nil {
+			t.Errorf("%s is accepted", name)
+		} else if errors.Is(err, ErrUnsupportedFeature) {
+			t.Errorf("%s is reported as unsupported: %v", name, err)
+		}
+	}
+}
+
+func TestDialectKeepsDuplicateId(t *testing.T) {
+	msg := message.New(nil)
+	msg.SetHeader("_AMQ_DUPL_ID", "first")
+	err := Artemis.SetDuplicateId(msg, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := msg.GetHeaders()["_AMQ_DUPL_ID"]; id != "first" {
+		t.Fatalf("duplicate id is replaced by %q", id)
+	}
+}
+
+func TestDialectSubscribeHeaders(t *testing.T) {
+	tests := []struct {
+		dialect  Dialect
+		selector string
+		expected map[string]string
+	}{
+		{ActiveMQ, "type = 'order'", map[string]string{
+			"activemq.subscriptionName": "billing",
+			"selector":                  "type = 'order'",
+			"activemq.prefetchSize":     "10",
+			"activemq.exclusive":        "true",
+			"activemq.priority":         "5",
+		}},
+		{RabbitMQ, "", map[string]string{
+			"durable":        "true",
+			"auto-delete":    "false",
+			"prefetch-count": "10",
+			"exclusive":      "true",
+			"x-priority":     "5",
+		}},
+	}
+	for _, test := range tests {
+		subscription := &Subscription{
+			Durable:   "billing",
+			Selector:  test.selector,
+			Prefetch:  10,
+			Exclusive: true,
+			Priority:  5,
+		}
+		client := &Client{dialect: test.dialect}
+		headers := make(map[string]string)
+		err := client.subscribeHeaders(subscription, headers)
+		if err != nil {
+			t.Errorf("%s: %v", test.dialect.Name(), err)
+			continue
+		}
+		if !reflect.DeepEqual(headers, test.expected) {
+			t.Errorf("%s: unexpected headers %v", test.dialect.Name(), headers)
+		}
+	}
+
+	//Artemis has no exclusive and consumer priority headers for STOMP
+	client := &Client{dialect: Artemis}
+	headers := make(map[string]string)
+	err := client.subscribeHeaders(&Subscription{Durable: "billing", Selector: "type = 'order'", Prefetch: 1024}, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"durable-subscription-name": "billing",
+		"selector":                  "type = 'order'",
+		"consumer-window-size":      "1024",
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Fatalf("Artemis: unexpected headers %v", headers)
+	}
+	if err := client.subscribeHeaders(&Subscription{Exclusive: true}, headers); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Fatalf("Artemis: expected ErrUnsupportedFeature for exclusive consumer, got %v", err)
+	}
+
+	client = &Client{dialect: RabbitMQ}
+	if err := client.subscribeHeaders(&Subscription{Selector: "a = 1"}, make(map[string]string)); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Fatalf("RabbitMQ: expected ErrUnsupportedFeature for selector, got %v", err)
+	}
+
+	client = &Client{dialect: Generic}
+	for _, subscription := range []*Subscription{{Durable: "billing"}, {Selector: "a = 1"}, {Prefetch: 1}} {
+		if err := client.subscribeHeaders(subscription, make(map[string]string)); !errors.Is(err, ErrUnsupportedFeature) {
+			t.Errorf("generic STOMP: expected ErrUnsupportedFeature, got %v", err)
+		}
+	}
+}
+
+func TestArtemisRoutingType(t *testing.T) {
+	tests := []struct {
+		destination string
+		subscribe   bool
+		expected    string
+		headers     map[string]string
+	}{
+		{"/queue/orders", false, "orders", map[string]string{"destination-type": "ANYCAST"}},
+		{"/topic/prices", false, "prices", map[string]string{"destination-type": "MULTICAST"}},
+		{"/queue/orders", true, "orders", map[string]string{"subscription-type": "ANYCAST"}},
+		{"/topic/prices", true, "prices", map[string]string{"subscription-type": "MULTICAST"}},
+		{"jms.queue.legacy", false, "jms.queue.legacy", map[string]string{}},
+	}
+
+	for _, test := range tests {
+		headers := make(map[string]string)
+		var destination string
+		if test.subscribe {
+			destination = Artemis.SubscribeDestination(test.destination, headers)
+		} else {
+			destination = Artemis.SendDestination(test.destination, headers)
+		}
+		if destination != test.expected || !reflect.DeepEqual(headers, test.headers) {
+			t.Errorf("%s: got %s with %v", test.destination, destination, headers)
+		}
+	}
+
+	headers := make(map[string]string)
+	if destination := ActiveMQ.SendDestination("/queue/orders", headers); destination != "/queue/orders" || len(headers) != 0 {
+		t.Fatalf("ActiveMQ rewrites the destination to %s with %v", destination, headers)
+	}
+}
@@ -0,0 +1,239 @@
+package gostomp
+
+import (
+	"container/heap"
+	"github.com/msidorenko/gostomp/message"
+	"strconv"
+	"sync"
+)
+
+const (
+	DefaultDispatchWorkers = 16
+	DefaultDispatchBuffer  = 256
+	//DefaultMessagePriority is used for messages without a valid priority header, as in JMS
+	DefaultMessagePriority = 4
+)
+
+//FairDispatchConfig describes the fair dispatcher, see WithFairDispatch
+type FairDispatchConfig struct {
+	//Workers is the number of callbacks running at once across all subscriptions, DefaultDispatchWorkers if zero
+	Workers int
+	//BufferSize is the number of messages buffered per subscription before delivery waits, DefaultDispatchBuffer if zero
+	BufferSize int
+}
+
+//WithFairDispatch run callbacks on a fixed pool of workers instead of a goroutine per message.
+//Every subscription has its own buffer, workers take messages from subscriptions by weighted round robin
+//(see Subscription.Weight), so a flood on one destination does not starve the others.
+//Within a subscription messages with higher priority header are handled first.
+//
+//When the buffer of a subscription is full delivery waits and the reader stops reading the socket,
+//which slows down all subscriptions of the connection. Receipts are still read, so callbacks may send with DELIVERY_SYNC.
+//Workers run from Connect until the client is closed.
+func WithFairDispatch(config FairDispatchConfig) ClientOption {
+	return func(client *Client) {
+		if config.Workers <= 0 {
+			config.Workers = DefaultDispatchWorkers
+		}
+		if config.BufferSize <= 0 {
+			config.BufferSize = DefaultDispatchBuffer
+		}
+
+		dispatcher := &dispatcher{client: client, workers: config.Workers, bufferSize: config.BufferSize}
+		dispatcher.notEmpty = sync.NewCond(&dispatcher.mutex)
+		dispatcher.notFull = sync.NewCond(&dispatcher.mutex)
+		client.dispatcher = dispatcher
+	}
+}
+
+//dispatcher keeps a buffer per subscription, empty buffers are removed
+type dispatcher struct {
+	client     *Client
+	workers    int
+	bufferSize int
+	mutex      sync.Mutex
+	notEmpty   *sync.Cond
+	notFull    *sync.Cond
+	queues     []*subscriptionQueue
+	seq        uint64
+	//active is set while workers run, generation changes whenever they are started or stopped
+	active     bool
+	generation uint64
+}
+
+type subscriptionQueue struct {
+	subscription *Subscription
+	deliveries   deliveryHeap
+	//current is the state of smooth weighted round robin
+	current int
+}
+
+type delivery struct {
+	priority int
+	seq      uint64
+	handle   func()
+}
+
+//start run workers until stop is closed
+func (dispatcher *dispatcher) start(stop <-chan struct{}) {
+	dispatcher.mutex.Lock()
+	dispatcher.active = true
+	dispatcher.generation++
+	generation := dispatcher.generation
+	dispatcher.mutex.Unlock()
+
+	for i := 0; i < dispatcher.workers; i++ {
+		go dispatcher.work(generation)
+	}
+	go func() {
+		<-stop
+		dispatcher.mutex.Lock()
+		defer dispatcher.mutex.Unlock()
+
+		if dispatcher.generation == generation {
+			dispatcher.active = false
+			dispatcher.generation++
+			dispatcher.notEmpty.Broadcast()
+			dispatcher.notFull.Broadcast()
+		}
+	}()
+}
+
+//dispatch buffer the delivery of the subscription, it waits while the buffer is full.
+//Without running workers the delivery is handled in its own goroutine.
+func (dispatcher *dispatcher) dispatch(subscription *Subscription, headers map[string]string, handle func()) {
+	priority, err := strconv.Atoi(headers[message.Priority])
+	if err != nil {
+		priority = DefaultMessagePriority
+	}
+
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	var queue *subscriptionQueue
+	for {
+		if !dispatcher.active {
+			dispatcher.client.resumeReading()
+			go handle()
+			return
+		}
+		//the queue may be removed while waiting if workers empty it
+		queue = dispatcher.queue(subscription)
+		if queue.deliveries.Len() < dispatcher.bufferSize {
+			break
+		}
+		dispatcher.client.flowPaused.Store(true)
+		dispatcher.notFull.Wait()
+	}
+	dispatcher.client.resumeReading()
+
+	dispatcher.seq++
+	heap.Push(&queue.deliveries, &delivery{priority: priority, seq: dispatcher.seq, handle: handle})
+	dispatcher.notEmpty.Signal()
+}
+
+//queue returns the buffer of the subscription, a new one is created if there is none
+func (dispatcher *dispatcher) queue(subscription *Subscription) *subscriptionQueue {
+	for _, queue := range dispatcher.queues {
+		if queue.subscription == subscription {
+			return queue
+		}
+	}
+
+	queue := &subscriptionQueue{subscription: subscription}
+	dispatcher.queues = append(dispatcher.queues, queue)
+	return queue
+}
+
+//work handle buffered deliveries, it exits when the generation of workers is stopped and nothing is buffered
+func (dispatcher *dispatcher) work(generation uint64) {
+	for {
+		dispatcher.mutex.Lock()
+		for len(dispatcher.queues) == 0 && dispatcher.generation == generation {
+			dispatcher.notEmpty.Wait()
+		}
+		if len(dispatcher.queues) == 0 {
+			dispatcher.mutex.Unlock()
+			return
+		}
+		next := dispatcher.next()
+		dispatcher.notFull.Broadcast()
+		dispatcher.mutex.Unlock()
+
+		next.handle()
+	}
+}
+
+//next pick the subscription by smooth weighted round robin and take its most important delivery
+func (dispatcher *dispatcher) next() *delivery {
+	var selected *subscriptionQueue
+	var selectedIndex, total int
+	for i, queue := range dispatcher.queues {
+		weight := queue.subscription.weight()
+		queue.current += weight
+		total += weight
+		if selected == nil || queue.current > selected.current {
+			selected, selectedIndex = queue, i
+		}
+	}
+	selected.current -= total
+
+	next := heap.Pop(&selected.deliveries).(*delivery)
+	if selected.deliveries.Len() == 0 {
+		dispatcher.queues = append(dispatcher.queues[:selectedIndex], dispatcher.queues[selectedIndex+1:]...)
+	}
+	return next
+}
+
+//Buffered returns the number of messages of the subscription waiting in the fair dispatcher
+func (client *Client) Buffered(subscription *Subscription) int {
+	if client.dispatcher == nil {
+		return 0
+	}
+
+	client.dispatcher.mutex.Lock()
+	defer client.dispatcher.mutex.Unlock()
+	for _, queue := range client.dispatcher.queues {
+		if queue.subscription == subscription {
+			return queue.deliveries.Len()
+		}
+	}
+	return 0
+}
+
+func (subs *Subscription) weight() int {
+	if subs.Weight <= 0 {
+		return 1
+	}
+	return subs.Weight
+}
+
+//deliveryHeap orders deliveries by priority, equal priorities in arrival order
+type deliveryHeap []*delivery
+
+func (deliveries deliveryHeap) Len() int {
+	return len(deliveries)
+}
+
+func (deliveries deliveryHeap) Less(i, j int) bool {
+	if deliveries[i].priority == deliveries[j].priority {
+		return deliveries[i].seq < deliveries[j].seq
+	}
+	return deliveries[i].priority > deliveries[j].priority
+}
+
+func (deliveries deliveryHeap) Swap(i, j int) {
+	deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+}
+
+func (deliveries *deliveryHeap) Push(x any) {
+	*deliveries = append(*deliveries, x.(*delivery))
+}
+
+func (deliveries *deliveryHeap) Pop() any {
+	old := *deliveries
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*deliveries = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,89 @@
+package gostomp
+
+import (
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestFairDispatchReadsReceiptsOfCallbacks(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613",
+		WithFairDispatch(FairDispatchConfig{Workers: 1, BufferSize: 1}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.startBackground()
+	broker := startPipe(t, client)
+
+	sent := make(chan error, 1)
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		Callback: func(msg *message.Message) {
+			if msg.GetID() == "m1" {
+				reply := message.New([]byte("done"))
+				reply.SetDestination("/queue/replies")
+				sent <- client.Producer(reply, DELIVERY_SYNC)
+			}
+		},
+	}
+	err = client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	//m2 fills the buffer while the only worker waits for the receipt, m3 waits for the buffer
+	broker.deliver(subscription, "m1")
+	broker.deliver(subscription, "m2")
+	broker.deliver(subscription, "m3")
+	headers := broker.expect(frame.SEND)
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receipt is not read while the dispatch buffer is full")
+	}
+}
+
+func TestFairDispatchWorkersStopWhenClosed(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613",
+		WithFairDispatch(FairDispatchConfig{Workers: 2}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.startBackground()
+	client.closed(nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.dispatcher.mutex.Lock()
+		active := client.dispatcher.active
+		client.dispatcher.mutex.Unlock()
+		if !active {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dispatcher is active after the client is closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	handled := make(chan struct{})
+	client.dispatcher.dispatch(&Subscription{}, map[string]string{}, func() { close(handled) })
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery after close is not handled")
+	}
+}
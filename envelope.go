@@ -0,0 +1,369 @@
+package gostomp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+const (
+	EncryptionKeyId     = "x-enc-key-id"
+	EncryptionAlg       = "x-enc-alg"
+	Signature           = "x-signature"
+	SignatureKeyId      = "x-signature-key-id"
+	SignatureAlg        = "x-signature-alg"
+	encryptionAlgAESGCM = "AES-GCM"
+)
+
+//EnvelopeConfig enables encryption and signing of message bodies independently of TLS
+type EnvelopeConfig struct {
+	//Keys provides AES keys (16, 24 or 32 bytes) for AES-GCM encryption, nil disables encryption
+	Keys KeyProvider
+	//Signer signs the body and SignedHeaders, nil disables signing
+	Signer Signer
+	//SignedHeaders are covered by the signature in addition to the body, e.g. destination or correlation-id.
+	//Their values are signed as they are written to the SEND frame, after the dialect translated the destination.
+	SignedHeaders []string
+	//AllowUnsealed accepts received messages which are not encrypted or not signed, e.g. while producers migrate.
+	//By default such messages are rejected when Keys or Signer is set, otherwise stripping the envelope
+	//headers would be enough to pass a forged message.
+	AllowUnsealed bool
+}
+
+//WithEnvelope encrypt and sign bodies on send and verify and decrypt them on receive.
+//Messages which fail verification are not passed to the callback and are NACKed in client ack modes.
+func WithEnvelope(config EnvelopeConfig) ClientOption {
+	return func(client *Client) {
+		client.envelope = &config
+	}
+}
+
+//KeyProvider supplies keys by id, CurrentKey is used for new messages
+//while Key resolves the id found in a received message, so old keys keep working after rotation
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+//KeyRing is KeyProvider with runtime rotation
+type KeyRing struct {
+	mutex   sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+//NewKeyRing create key ring which uses the key with currentID for new messages
+func NewKeyRing(currentID string, keys map[string][]byte) *KeyRing {
+	ring := &KeyRing{current: currentID, keys: make(map[string][]byte)}
+	for id, key := range keys {
+		ring.keys[id] = key
+	}
+	return ring
+}
+
+//Rotate add the key and make it current, previous keys remain available for received messages
+func (ring *KeyRing) Rotate(id string, key []byte) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	ring.keys[id] = key
+	ring.current = id
+}
+
+//Remove forget the key, messages using it can no longer be read
+func (ring *KeyRing) Remove(id string) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	delete(ring.keys, id)
+}
+
+func (ring *KeyRing) CurrentKey() (string, []byte, error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	key, ok := ring.keys[ring.current]
+	if !ok {
+		return "", nil, errors.New("current key '" + ring.current + "' is not in the key ring")
+	}
+	return ring.current, key, nil
+}
+
+func (ring *KeyRing) Key(id string) ([]byte, error) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+
+	key, ok := ring.keys[id]
+	if !ok {
+		return nil, errors.New("key '" + id + "' is not in the key ring")
+	}
+	return key, nil
+}
+
+//Signer signs and verifies envelope data
+type Signer interface {
+	Algorithm() string
+	Sign(data []byte) (keyID string, signature []byte, err error)
+	Verify(keyID string, data, signature []byte) error
+}
+
+type hmacSigner struct {
+	keys KeyProvider
+}
+
+//HMACSigner signs with HMAC-SHA256 using shared keys
+func HMACSigner(keys KeyProvider) Signer {
+	return &hmacSigner{keys: keys}
+}
+
+func (s *hmacSigner) Algorithm() string {
+	return "HMAC-SHA256"
+}
+
+func (s *hmacSigner) Sign(data []byte) (string, []byte, error) {
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return id, mac.Sum(nil), nil
+}
+
+func (s *hmacSigner) Verify(keyID string, data, signature []byte) error {
+	key, err := s.keys.Key(keyID)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("HMAC signature mismatch")
+	}
+	return nil
+}
+
+type ed25519Signer struct {
+	privateKeys KeyProvider
+	publicKeys  KeyProvider
+}
+
+//Ed25519Signer signs with ed25519.PrivateKey from privateKeys.CurrentKey
+//and verifies with ed25519.PublicKey from publicKeys.Key.
+//A producer-only client may pass nil publicKeys, a consumer-only client nil privateKeys.
+func Ed25519Signer(privateKeys, publicKeys KeyProvider) Signer {
+	return &ed25519Signer{privateKeys: privateKeys, publicKeys: publicKeys}
+}
+
+func (s *ed25519Signer) Algorithm() string {
+	return "Ed25519"
+}
+
+func (s *ed25519Signer) Sign(data []byte) (string, []byte, error) {
+	if s.privateKeys == nil {
+		return "", nil, errors.New("Ed25519 private keys are not configured")
+	}
+	id, key, err := s.privateKeys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return "", nil, errors.New("Ed25519 private key '" + id + "' has invalid size")
+	}
+	return id, ed25519.Sign(ed25519.PrivateKey(key), data), nil
+}
+
+func (s *ed25519Signer) Verify(keyID string, data, signature []byte) error {
+	if s.publicKeys == nil {
+		return errors.New("Ed25519 public keys are not configured")
+	}
+	key, err := s.publicKeys.Key(keyID)
+	if err != nil {
+		return err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("Ed25519 public key '" + keyID + "' has invalid size")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, signature) {
+		return errors.New("Ed25519 signature mismatch")
+	}
+	return nil
+}
+
+//sealMiddleware send an encrypted and signed copy of the message
+func (client *Client) sealMiddleware(next SendFunc) SendFunc {
+	return func(msg *message.Message, deliveryMode bool) error {
+		config := client.envelope
+		if config == nil || (config.Keys == nil && config.Signer == nil) {
+			return next(msg, deliveryMode)
+		}
+
+		//the message of the caller is left untouched, so it can be sent again
+		sealed := copyMessage(msg, msg.GetBody())
+
+		if config.Keys != nil {
+			id, key, err := config.Keys.CurrentKey()
+			if err != nil {
+				return errors.New("Cannot get encryption key. Reason: " + err.Error())
+			}
+			body, err := encryptBody(key, id, msg.GetBody())
+			if err != nil {
+				return errors.New("Cannot encrypt message body. Reason: " + err.Error())
+			}
+			sealed.SetBody(body)
+			sealed.SetHeader(EncryptionKeyId, id)
+			sealed.SetHeader(EncryptionAlg, encryptionAlgAESGCM)
+		}
+
+		if config.Signer != nil {
+			sealed.SetHeader(SignatureAlg, config.Signer.Algorithm())
+			//headers are signed with the values the consumer receives, the dialect may rewrite the destination
+			framed := client.sendFrame(sealed)
+			id, signature, err := config.Signer.Sign(signedData(framed.Headers, sealed.GetBody(), config.SignedHeaders))
+			if err != nil {
+				return errors.New("Cannot sign message. Reason: " + err.Error())
+			}
+			sealed.SetHeader(SignatureKeyId, id)
+			sealed.SetHeader(Signature, base64.StdEncoding.EncodeToString(signature))
+		}
+
+		return next(sealed, deliveryMode)
+	}
+}
+
+//openMiddleware verify and decrypt received messages, tampered messages are rejected
+func (client *Client) openMiddleware(next SubscriptionCallback) SubscriptionCallback {
+	return func(msg *message.Message) {
+		config := client.envelope
+		if config == nil || (config.Keys == nil && config.Signer == nil) {
+			next(msg)
+			return
+		}
+
+		err := openEnvelope(config, msg)
+		if err != nil {
+			client.logger.Warn("message rejected by envelope verification",
+				slog.String("message-id", msg.GetID()),
+				slog.String("subscription", msg.GetHeaders()[message.Subscription]),
+				slog.Any("error", err),
+			)
+			client.reject(msg)
+			return
+		}
+		next(msg)
+	}
+}
+
+func openEnvelope(config *EnvelopeConfig, msg *message.Message) error {
+	headers := msg.GetHeaders()
+
+	if config.Signer != nil {
+		encoded, signed := headers[Signature]
+		if signed {
+			if headers[SignatureAlg] != config.Signer.Algorithm() {
+				return errors.New("unexpected signature algorithm '" + headers[SignatureAlg] + "'")
+			}
+			signature, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return errors.New("malformed signature")
+			}
+			err = config.Signer.Verify(headers[SignatureKeyId], signedData(headers, msg.GetBody(), config.SignedHeaders), signature)
+			if err != nil {
+				return err
+			}
+		} else if !config.AllowUnsealed {
+			return errors.New("message is not signed")
+		}
+	}
+
+	if config.Keys != nil {
+		id, encrypted := headers[EncryptionKeyId]
+		if encrypted {
+			if headers[EncryptionAlg] != encryptionAlgAESGCM {
+				return errors.New("unexpected encryption algorithm '" + headers[EncryptionAlg] + "'")
+			}
+			key, err := config.Keys.Key(id)
+			if err != nil {
+				return err
+			}
+			body, err := decryptBody(key, id, msg.GetBody())
+			if err != nil {
+				return err
+			}
+			msg.SetBody(body)
+			delete(headers, EncryptionKeyId)
+			delete(headers, EncryptionAlg)
+			msg.SetHeader(message.ContentLength, strconv.Itoa(len(body)))
+		} else if !config.AllowUnsealed {
+			return errors.New("message is not encrypted")
+		}
+	}
+	return nil
+}
+
+//signedData is the canonical form covered by the signature: selected headers, encryption headers and the body.
+//Every header name, value and the body is prefixed with its length, so bytes cannot be moved
+//from one of them to another, e.g. from a header value with a newline to the body, without breaking the signature.
+func signedData(headers map[string]string, body []byte, signedHeaders []string) []byte {
+	var buf bytes.Buffer
+	for _, key := range append([]string{EncryptionKeyId, EncryptionAlg, SignatureAlg}, signedHeaders...) {
+		writeSignedField(&buf, []byte(key))
+		writeSignedField(&buf, []byte(headers[key]))
+	}
+	writeSignedField(&buf, body)
+	return buf.Bytes()
+}
+
+func writeSignedField(buf *bytes.Buffer, data []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+	buf.Write(size[:])
+	buf.Write(data)
+}
+
+//encryptBody returns nonce followed by AES-GCM ciphertext, the key id is authenticated as additional data
+func encryptBody(key []byte, keyID string, body []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, body, []byte(keyID)), nil
+}
+
+func decryptBody(key []byte, keyID string, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted body is too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,232 @@
+package gostomp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func newEnvelopeClient(t *testing.T, config EnvelopeConfig) *Client {
+	t.Helper()
+
+	client, err := NewClient("tcp://localhost:61613?dialect=artemis",
+		WithEnvelope(config),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+//seal returns the MESSAGE frame a consumer receives for msg sent through the send chain of client
+func seal(t *testing.T, client *Client, msg *message.Message) *frame.Frame {
+	t.Helper()
+
+	var sent *frame.Frame
+	send := client.sendChain(func(msg *message.Message, deliveryMode bool) error {
+		sent = client.sendFrame(msg)
+		return nil
+	})
+	err := send(msg, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent.Command = frame.MESSAGE
+	return sent
+}
+
+//open pass the frame to the receive chain of client, it returns nil if the message was rejected
+func open(client *Client, frm *frame.Frame) *message.Message {
+	var received *message.Message
+	callback := client.openMiddleware(func(msg *message.Message) {
+		received = msg
+	})
+	callback(message.NewFromFrame(frm))
+	return received
+}
+
+func newTestMessage() *message.Message {
+	msg := message.New([]byte("order #42"))
+	msg.SetID("m1")
+	msg.SetDestination("/queue/orders")
+	msg.SetCorrelationId("c1")
+	return msg
+}
+
+func randomKey(t *testing.T, size int) []byte {
+	t.Helper()
+
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := map[string]Signer{
+		"HMAC": HMACSigner(NewKeyRing("mac-1", map[string][]byte{"mac-1": randomKey(t, 32)})),
+		"Ed25519": Ed25519Signer(
+			NewKeyRing("sig-1", map[string][]byte{"sig-1": privateKey}),
+			NewKeyRing("sig-1", map[string][]byte{"sig-1": publicKey}),
+		),
+	}
+
+	for name, signer := range signers {
+		t.Run(name, func(t *testing.T) {
+			client := newEnvelopeClient(t, EnvelopeConfig{
+				Keys:          NewKeyRing("enc-1", map[string][]byte{"enc-1": randomKey(t, 32)}),
+				Signer:        signer,
+				SignedHeaders: []string{message.Destination, message.CorrelationId},
+			})
+
+			msg := newTestMessage()
+			frm := seal(t, client, msg)
+			if bytes.Contains(frm.Body, msg.GetBody()) {
+				t.Fatal("body is sent in plain text")
+			}
+			if frm.Headers[message.Destination] != "orders" {
+				t.Fatalf("destination is not translated by the dialect: %q", frm.Headers[message.Destination])
+			}
+
+			received := open(client, frm)
+			if received == nil {
+				t.Fatal("sealed message is rejected")
+			}
+			if string(received.GetBody()) != "order #42" {
+				t.Fatalf("unexpected body %q", received.GetBody())
+			}
+			if string(msg.GetBody()) != "order #42" {
+				t.Fatal("message of the caller is modified")
+			}
+		})
+	}
+}
+
+func TestEnvelopeKeyRotation(t *testing.T) {
+	keys := NewKeyRing("enc-1", map[string][]byte{"enc-1": randomKey(t, 16)})
+	client := newEnvelopeClient(t, EnvelopeConfig{Keys: keys})
+
+	frm := seal(t, client, newTestMessage())
+	keys.Rotate("enc-2", randomKey(t, 16))
+
+	received := open(client, frm)
+	if received == nil || string(received.GetBody()) != "order #42" {
+		t.Fatal("message sealed with the previous key cannot be opened after rotation")
+	}
+
+	keys.Remove("enc-1")
+	if open(client, seal(t, client, newTestMessage())) == nil {
+		t.Fatal("message sealed with the current key is rejected")
+	}
+	if open(client, frm) != nil {
+		t.Fatal("message sealed with a removed key is accepted")
+	}
+}
+
+func TestEnvelopeRejectsTamperedMessages(t *testing.T) {
+	config := EnvelopeConfig{
+		Keys:          NewKeyRing("enc-1", map[string][]byte{"enc-1": randomKey(t, 32)}),
+		Signer:        HMACSigner(NewKeyRing("mac-1", map[string][]byte{"mac-1": randomKey(t, 32)})),
+		SignedHeaders: []string{message.Destination, message.CorrelationId},
+	}
+	client := newEnvelopeClient(t, config)
+
+	tests := map[string]func(frm *frame.Frame){
+		"body": func(frm *frame.Frame) {
+			frm.Body[len(frm.Body)-1] ^= 1
+		},
+		"signed header": func(frm *frame.Frame) {
+			frm.Headers[message.CorrelationId] = "c2"
+		},
+		"destination": func(frm *frame.Frame) {
+			frm.Headers[message.Destination] = "payments"
+		},
+		"encryption key id": func(frm *frame.Frame) {
+			frm.Headers[EncryptionKeyId] = "enc-2"
+		},
+		"signature": func(frm *frame.Frame) {
+			frm.Headers[Signature] = "AAAA"
+		},
+		"stripped signature": func(frm *frame.Frame) {
+			delete(frm.Headers, Signature)
+			delete(frm.Headers, SignatureKeyId)
+			delete(frm.Headers, SignatureAlg)
+		},
+		"stripped encryption": func(frm *frame.Frame) {
+			frm.Body = []byte("forged order")
+			delete(frm.Headers, EncryptionKeyId)
+			delete(frm.Headers, EncryptionAlg)
+		},
+	}
+
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			frm := seal(t, client, newTestMessage())
+			tamper(frm)
+			if open(client, frm) != nil {
+				t.Fatal("tampered message is accepted")
+			}
+		})
+	}
+}
+
+func TestEnvelopeRejectsBytesMovedBetweenFields(t *testing.T) {
+	client := newEnvelopeClient(t, EnvelopeConfig{
+		Signer:        HMACSigner(NewKeyRing("mac-1", map[string][]byte{"mac-1": randomKey(t, 32)})),
+		SignedHeaders: []string{message.CorrelationId},
+	})
+
+	msg := message.New([]byte("order #42"))
+	msg.SetDestination("/queue/orders")
+	msg.SetCorrelationId("c1\nfree shipping")
+	frm := seal(t, client, msg)
+
+	//"correlation-id:c1\nfree shipping\n" + "order #42" reads the same as "correlation-id:c1\n" + "free shipping\norder #42"
+	frm.Headers[message.CorrelationId] = "c1"
+	frm.Body = []byte("free shipping\norder #42")
+	if open(client, frm) != nil {
+		t.Fatal("message with bytes moved from a signed header to the body is accepted")
+	}
+
+	frm = seal(t, client, msg)
+	if open(client, frm) == nil {
+		t.Fatal("signed message with a newline in a signed header is rejected")
+	}
+}
+
+func TestEnvelopeAllowUnsealed(t *testing.T) {
+	keys := NewKeyRing("enc-1", map[string][]byte{"enc-1": randomKey(t, 32)})
+	signer := HMACSigner(NewKeyRing("mac-1", map[string][]byte{"mac-1": randomKey(t, 32)}))
+
+	plain := newEnvelopeClient(t, EnvelopeConfig{})
+	frm := seal(t, plain, newTestMessage())
+
+	strict := newEnvelopeClient(t, EnvelopeConfig{Keys: keys, Signer: signer})
+	if open(strict, frm) != nil {
+		t.Fatal("unsealed message is accepted by default")
+	}
+	encryptOnly := newEnvelopeClient(t, EnvelopeConfig{Keys: keys})
+	if open(encryptOnly, frm) != nil {
+		t.Fatal("plain text message is accepted by default")
+	}
+
+	lenient := newEnvelopeClient(t, EnvelopeConfig{Keys: keys, Signer: signer, AllowUnsealed: true})
+	received := open(lenient, frm)
+	if received == nil || string(received.GetBody()) != "order #42" {
+		t.Fatal("unsealed message is rejected with AllowUnsealed")
+	}
+}
@@ -0,0 +1,198 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"sync"
+)
+
+//FLOW_PAUSE stops reading the socket while the window of a subscription is full, so the broker is slowed down
+//by TCP backpressure. Frames of all subscriptions of the connection wait as well.
+//The socket is still read while somebody waits for a receipt, so callbacks may send with DELIVERY_SYNC.
+const FLOW_PAUSE = "pause"
+
+//FLOW_RESUBSCRIBE sends UNSUBSCRIBE when the window of a subscription is full and SUBSCRIBE again
+//when half of the window is free. Other subscriptions are not affected.
+//Brokers redeliver unacknowledged messages of a removed subscription, so it fits ACK_AUTO subscriptions best.
+const FLOW_RESUBSCRIBE = "resubscribe"
+
+//flowWindow counts messages of a subscription which are handed to the callback and have not returned yet,
+//in client ack modes messages which are not acknowledged yet
+type flowWindow struct {
+	mutex    sync.Mutex
+	limit    int
+	inFlight int
+	//detached is set while the subscription is unsubscribed by FLOW_RESUBSCRIBE
+	detached bool
+	//released wakes up the paused delivery when a slot is freed
+	released chan struct{}
+	stop     chan struct{}
+}
+
+func newFlowWindow(subscription *Subscription) (*flowWindow, error) {
+	if subscription.MaxInFlight < 0 {
+		return nil, errors.New("max in flight must not be negative")
+	}
+	switch subscription.FlowControl {
+	case "", FLOW_PAUSE, FLOW_RESUBSCRIBE:
+	default:
+		return nil, errors.New("unknown flow control '" + subscription.FlowControl + "'")
+	}
+	if subscription.MaxInFlight == 0 {
+		return nil, nil
+	}
+	if subscription.Ack == ACK_CLIENT && subscription.AckBatchSize > subscription.MaxInFlight {
+		//the window is freed by ACK, a batch which does not fit would never be sent
+		return nil, errors.New("ack batch size must not exceed max in flight")
+	}
+
+	return &flowWindow{
+		limit:    subscription.MaxInFlight,
+		released: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+//InFlight returns the number of messages handed to Callback which have not returned yet,
+//for ACK_CLIENT and ACK_CLIENT_INDIVIDUAL the number of messages which are not acknowledged yet.
+//It is tracked only when MaxInFlight is set.
+func (subs *Subscription) InFlight() int {
+	if subs.window == nil {
+		return 0
+	}
+
+	subs.window.mutex.Lock()
+	defer subs.window.mutex.Unlock()
+	return subs.window.inFlight
+}
+
+//detached reports whether the subscription is unsubscribed by FLOW_RESUBSCRIBE at the moment
+func (subs *Subscription) detached() bool {
+	if subs.window == nil {
+		return false
+	}
+
+	subs.window.mutex.Lock()
+	defer subs.window.mutex.Unlock()
+	return subs.window.detached
+}
+
+//acquireWindow take a slot of the subscription window for the delivered message.
+//It returns false if the subscription was removed while delivery was paused, the message is dropped then.
+func (client *Client) acquireWindow(subscription *Subscription) bool {
+	window := subscription.window
+	if window == nil {
+		return true
+	}
+
+	if subscription.FlowControl == FLOW_RESUBSCRIBE {
+		//messages sent by the broker before UNSUBSCRIBE still arrive and are dispatched over the limit
+		window.mutex.Lock()
+		defer window.mutex.Unlock()
+
+		window.inFlight++
+		if !window.detached && !client.draining.Load() && window.inFlight >= window.limit {
+			window.detached = true
+			client.detachSubscription(subscription)
+		}
+		return true
+	}
+
+	for {
+		window.mutex.Lock()
+		if window.inFlight < window.limit {
+			window.inFlight++
+			window.mutex.Unlock()
+			return true
+		}
+		window.mutex.Unlock()
+
+		if !client.flowPaused.Load() {
+			client.flowPaused.Store(true)
+			client.logger.Debug("reading paused by flow control", subscriptionAttrs(subscription)...)
+		}
+
+		select {
+		case <-window.released:
+		case <-window.stop:
+			client.resumeReading()
+			return false
+		}
+		client.resumeReading()
+	}
+}
+
+//resumeReading wake up the reader after delivery waited for flow control
+func (client *Client) resumeReading() {
+	if client.flowPaused.Load() {
+		client.flowPaused.Store(false)
+		client.wakeReader()
+	}
+}
+
+//releaseWindow free slots taken by acquireWindow when the callback returns,
+//in client ack modes when the messages are acknowledged
+func (client *Client) releaseWindow(subscription *Subscription, count int) {
+	window := subscription.window
+	if window == nil || count == 0 {
+		return
+	}
+
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+
+	window.inFlight -= count
+	if window.detached && window.inFlight <= window.limit/2 {
+		window.detached = false
+		client.reattachSubscription(subscription)
+	}
+
+	select {
+	case window.released <- struct{}{}:
+	default:
+	}
+}
+
+//detachSubscription send UNSUBSCRIBE but keep the subscription registered, so messages which are already
+//on the way are still dispatched. It is called with the window mutex held to keep UNSUBSCRIBE and SUBSCRIBE in order.
+func (client *Client) detachSubscription(subscription *Subscription) {
+	client.logger.Debug("subscription detached by flow control", subscriptionAttrs(subscription)...)
+
+	frm := frame.NewFrame(frame.UNSUBSCRIBE, []byte(""))
+	frm.Headers[message.Id] = subscription.GetID()
+	err := client.sender(frm)
+	if err != nil {
+		client.logger.Error("cannot detach subscription", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+	}
+}
+
+//reattachSubscription send SUBSCRIBE with the same id again
+func (client *Client) reattachSubscription(subscription *Subscription) {
+	select {
+	case <-subscription.window.stop:
+		//unsubscribed by the user in the meantime
+		return
+	default:
+	}
+	if client.draining.Load() {
+		return
+	}
+	if subscription.tracker != nil {
+		//the broker redelivers messages which were not acknowledged before UNSUBSCRIBE, their ack ids are not valid anymore
+		removed := subscription.tracker.reset()
+		subscription.window.inFlight -= len(removed)
+		settle(removed, false)
+	}
+
+	client.logger.Debug("subscription reattached by flow control", subscriptionAttrs(subscription)...)
+
+	frm, err := client.subscribeFrame(subscription)
+	if err == nil {
+		err = client.sender(frm)
+	}
+	if err != nil {
+		client.logger.Error("cannot reattach subscription", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+	}
+}
@@ -0,0 +1,193 @@
+package gostomp
+
+import (
+	"bufio"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//pipeBroker is the server side of a connection made by startPipe
+type pipeBroker struct {
+	t      *testing.T
+	conn   net.Conn
+	writer *Writer
+	//frames receives frames written by the client as "COMMAND" followed by header lines
+	frames chan string
+}
+
+//startPipe connect the client to an in-memory broker without the CONNECT handshake
+func startPipe(t *testing.T, client *Client) *pipeBroker {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	broker := &pipeBroker{t: t, conn: serverConn, writer: NewWriter(serverConn, 4096), frames: make(chan string, 64)}
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		for {
+			raw, err := reader.ReadString(0)
+			if err != nil {
+				close(broker.frames)
+				return
+			}
+			broker.frames <- strings.TrimLeft(strings.SplitN(raw, "\n\n", 2)[0], "\n")
+		}
+	}()
+
+	client.setConn(clientConn)
+	inbox := newInbox()
+	client.inbox.Store(inbox)
+	client.setState(StateConnected)
+	done := make(chan struct{})
+	go client.readerLoop(NewReader(clientConn, 4096), inbox, done)
+	go client.deliverLoop(inbox)
+
+	t.Cleanup(func() {
+		serverConn.Close()
+		<-done
+	})
+	return broker
+}
+
+func (broker *pipeBroker) send(command string, headers map[string]string) {
+	broker.t.Helper()
+
+	frm := frame.NewFrame(command, []byte(""))
+	for key, value := range headers {
+		frm.Headers[key] = value
+	}
+	err := broker.writer.Write(frm)
+	if err != nil {
+		broker.t.Fatal(err)
+	}
+}
+
+//expect returns the next frame of the client with the command, other frames are skipped
+func (broker *pipeBroker) expect(command string) map[string]string {
+	broker.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case raw, ok := <-broker.frames:
+			if !ok {
+				broker.t.Fatalf("connection closed while waiting for %s", command)
+			}
+			lines := strings.Split(raw, "\n")
+			if lines[0] != command {
+				continue
+			}
+			headers := make(map[string]string)
+			for _, line := range lines[1:] {
+				key, value, _ := strings.Cut(line, ":")
+				headers[key] = value
+			}
+			return headers
+		case <-timeout:
+			broker.t.Fatalf("timeout waiting for %s", command)
+			return nil
+		}
+	}
+}
+
+func (broker *pipeBroker) deliver(subscription *Subscription, messageId string) {
+	broker.t.Helper()
+
+	broker.send(frame.MESSAGE, map[string]string{
+		message.Subscription: subscription.GetID(),
+		message.MessageId:    messageId,
+		message.Destination:  subscription.Destination,
+		message.Ack:          "ack-" + messageId,
+	})
+}
+
+func TestFlowPauseReadsReceiptsOfCallbacks(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	sent := make(chan error, 1)
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		MaxInFlight: 1,
+		Callback: func(msg *message.Message) {
+			if msg.GetID() == "m1" {
+				reply := message.New([]byte("done"))
+				reply.SetDestination("/queue/replies")
+				sent <- client.Producer(reply, DELIVERY_SYNC)
+			}
+		},
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	//m2 waits for the window held by the callback of m1, which waits for its receipt
+	broker.deliver(subscription, "m1")
+	broker.deliver(subscription, "m2")
+	headers := broker.expect(frame.SEND)
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receipt is not read while delivery is paused")
+	}
+}
+
+func TestWindowIsFreedByAck(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	received := make(chan *message.Message, 4)
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		Ack:         ACK_CLIENT_INDIVIDUAL,
+		MaxInFlight: 1,
+		Callback: func(msg *message.Message) {
+			received <- msg
+		},
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	broker.deliver(subscription, "m1")
+	broker.deliver(subscription, "m2")
+	first := <-received
+	select {
+	case msg := <-received:
+		t.Fatalf("message %s is delivered before the previous one is acknowledged", msg.GetID())
+	case <-time.After(100 * time.Millisecond):
+	}
+	if inFlight := subscription.InFlight(); inFlight != 1 {
+		t.Fatalf("expected 1 message in flight, got %d", inFlight)
+	}
+
+	client.Ack(first)
+	broker.expect(frame.ACK)
+	select {
+	case msg := <-received:
+		if msg.GetID() != "m2" {
+			t.Fatalf("unexpected message %s", msg.GetID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("window is not freed by ACK")
+	}
+}
+
+func TestAckBatchMustFitWindow(t *testing.T) {
+	_, err := newFlowWindow(&Subscription{Ack: ACK_CLIENT, MaxInFlight: 10, AckBatchSize: 20})
+	if err == nil {
+		t.Fatal("ack batch larger than the window is accepted")
+	}
+}
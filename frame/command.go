@@ -13,6 +13,9 @@ const (
 	UNSUBSCRIBE = "UNSUBSCRIBE"
 	ACK         = "ACK"
 	NACK        = "NACK"
+	BEGIN       = "BEGIN"
+	COMMIT      = "COMMIT"
+	ABORT       = "ABORT"
 
 	// Server commands
 	MESSAGE = "MESSAGE"
@@ -1,5 +1,10 @@
 package frame
 
+//RedactedHeaders lists headers whose values are masked in frame traces of the client
+var RedactedHeaders = map[string]bool{
+	"passcode": true,
+}
+
 type Frame struct {
 	Command string
 	Headers map[string]string
@@ -0,0 +1,108 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	DefaultGroupWorkers = 8
+	//DefaultGroupBuffer is the number of messages waiting for a group worker before delivery waits
+	DefaultGroupBuffer = 64
+)
+
+//GroupKeyFunc returns the key of a message, messages with the same key are handled one by one in order.
+//It receives the message as it arrived, before decompression and decryption.
+type GroupKeyFunc func(msg *message.Message) string
+
+//groupRouter hands messages of a subscription to a fixed number of workers by hash of their key
+type groupRouter struct {
+	mutex   sync.RWMutex
+	workers []chan func()
+	closed  bool
+	//sending counts routes which hand a delivery to a worker, close waits for them before closing workers
+	sending sync.WaitGroup
+}
+
+func newGroupRouter(subscription *Subscription) (*groupRouter, error) {
+	if subscription.GroupHeader == "" && subscription.GroupKey == nil {
+		if subscription.GroupWorkers != 0 {
+			return nil, errors.New("group workers require GroupHeader or GroupKey")
+		}
+		return nil, nil
+	}
+	if subscription.GroupWorkers < 0 {
+		return nil, errors.New("group workers must not be negative")
+	}
+
+	count := subscription.GroupWorkers
+	if count == 0 {
+		count = DefaultGroupWorkers
+	}
+
+	router := &groupRouter{workers: make([]chan func(), count)}
+	for i := range router.workers {
+		worker := make(chan func(), DefaultGroupBuffer)
+		router.workers[i] = worker
+		go func() {
+			for handle := range worker {
+				handle()
+			}
+		}()
+	}
+	return router, nil
+}
+
+//groupKey returns the key of the frame, GroupKey takes precedence over GroupHeader
+func (subs *Subscription) groupKey(frm *frame.Frame) string {
+	if subs.GroupKey != nil {
+		return subs.GroupKey(message.NewFromFrame(frm))
+	}
+	return frm.Headers[subs.GroupHeader]
+}
+
+//route hand the delivery to the worker of the key, messages without a key are handled concurrently.
+//It waits while the buffer of the worker is full, the lock is not held meanwhile.
+func (client *Client) route(router *groupRouter, key string, handle func()) {
+	router.mutex.RLock()
+	if key == "" || router.closed {
+		router.mutex.RUnlock()
+		go handle()
+		return
+	}
+	router.sending.Add(1)
+	router.mutex.RUnlock()
+	defer router.sending.Done()
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	worker := router.workers[hash.Sum32()%uint32(len(router.workers))]
+
+	select {
+	case worker <- handle:
+	default:
+		client.flowPaused.Store(true)
+		worker <- handle
+		client.resumeReading()
+	}
+}
+
+//close stop workers after they handle buffered messages
+func (router *groupRouter) close() {
+	router.mutex.Lock()
+	if router.closed {
+		router.mutex.Unlock()
+		return
+	}
+	router.closed = true
+	router.mutex.Unlock()
+
+	//no route passes the check anymore, those which did must not send to a closed worker
+	router.sending.Wait()
+	for _, worker := range router.workers {
+		close(worker)
+	}
+}
@@ -0,0 +1,70 @@
+package gostomp
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouteDoesNotBlockOthersWhileClosing(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := newGroupRouter(&Subscription{GroupHeader: "JMSXGroupID", GroupWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	var handled sync.WaitGroup
+	handle := func() {
+		defer handled.Done()
+		<-block
+	}
+
+	//the worker is busy and its buffer is full, the next route of the key waits
+	handled.Add(DefaultGroupBuffer + 2)
+	for i := 0; i < DefaultGroupBuffer+1; i++ {
+		client.route(router, "a", handle)
+	}
+	go client.route(router, "a", handle)
+	time.Sleep(20 * time.Millisecond)
+
+	go router.close()
+	for {
+		router.mutex.RLock()
+		closed := router.closed
+		router.mutex.RUnlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	routed := make(chan struct{})
+	handled.Add(1)
+	go func() {
+		client.route(router, "b", handle)
+		close(routed)
+	}()
+	select {
+	case <-routed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("route waits for the router lock held by a blocked route")
+	}
+
+	close(block)
+	done := make(chan struct{})
+	go func() {
+		handled.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries are lost while the router closes")
+	}
+}
@@ -0,0 +1,98 @@
+package gostomp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//heartBeatTolerance is how many negotiated intervals may pass without any data from the server
+//before a heart-beat is considered missed
+const heartBeatTolerance = 2
+
+//parseHeartBeat returns both values of a heart-beat header "<cx>,<cy>" in milliseconds
+func parseHeartBeat(value string) (int64, int64, error) {
+	settings := strings.Split(value, ",")
+	if len(settings) != 2 {
+		return 0, 0, errors.New(value + " is not two integers separated by a comma")
+	}
+
+	values := make([]int64, 2)
+	for i, setting := range settings {
+		parsed, err := strconv.ParseInt(strings.TrimSpace(setting), 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New(setting + " is not a non-negative integer")
+		}
+		values[i] = parsed
+	}
+	return values[0], values[1], nil
+}
+
+//monitorHeartBeats check every negotiated interval that the server has sent something recently.
+//A silent connection is considered dead and closed, the reader then reports it as lost.
+//It stops when done is closed.
+func (client *Client) monitorHeartBeats(conn io.Closer, inbox *inbox, done <-chan struct{}) {
+	interval := time.Duration(client.connection.heartBeatServer) * time.Millisecond
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if inbox.waiting.Load() {
+				//the server is not read while flow control holds the reader
+				continue
+			}
+			silence := time.Since(time.Unix(0, client.lastReceived.Load()))
+			if silence > interval*heartBeatTolerance {
+				client.metrics.HeartbeatMissed()
+				client.logger.Warn("server heart-beat missed", slog.Duration("silence", silence))
+				client.emitHeartbeatTimeout(silence)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+//sendHeartBeats write EOL every negotiated interval in which no frame was sent.
+//It stops when done is closed.
+func (client *Client) sendHeartBeats(done <-chan struct{}) {
+	interval := time.Duration(client.connection.heartBeatClient) * time.Millisecond
+	if interval <= 0 {
+		return
+	}
+
+	//heart-beats are sent a bit more often than negotiated to absorb network delays
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, client.lastSent.Load())) < interval/2 {
+				continue
+			}
+
+			client.writeMutex.Lock()
+			_, err := client.connection.conn.Write([]byte{'\n'})
+			client.writeMutex.Unlock()
+			if err != nil {
+				client.logger.Debug("cannot send heart-beat", slog.Any("error", err))
+				continue
+			}
+			client.lastSent.Store(time.Now().UnixNano())
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package gostomp
+
+import (
+	"bufio"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+//connectTo connect a client with the DSN query to a server which answers CONNECT with the heart-beat header.
+//The header is left out if heartBeat is nil.
+func connectTo(t *testing.T, query string, heartBeat *string) (*Client, error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		_, err = bufio.NewReader(conn).ReadString(0)
+		if err != nil {
+			return
+		}
+		connected := frame.NewFrame(frame.CONNECTED, []byte(""))
+		connected.Headers[message.Version] = "1.2"
+		if heartBeat != nil {
+			connected.Headers[message.Heartbeat] = *heartBeat
+		}
+		NewWriter(conn, 4096).Write(connected)
+	}()
+
+	client, err := NewClient("tcp://"+listener.Addr().String()+query, WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Connect()
+	if err == nil {
+		t.Cleanup(func() { client.closed(nil) })
+	}
+	return client, err
+}
+
+func TestHeartBeatNegotiation(t *testing.T) {
+	header := func(value string) *string { return &value }
+	tests := []struct {
+		name      string
+		query     string
+		heartBeat *string
+		client    int64
+		server    int64
+	}{
+		{"missing header", "?heart-beat=1000,1000", nil, 0, 0},
+		{"server disables both", "?heart-beat=1000,1000", header("0,0"), 0, 0},
+		{"client disables both", "", header("500,500"), 0, 0},
+		{"larger interval wins", "?heart-beat=1000,1000", header("2000,500"), 1000, 2000},
+		{"server wants heart-beats only", "?heart-beat=1000,1000", header("0,3000"), 3000, 0},
+		{"spaces", "?heart-beat=1000,1000", header(" 500, 500"), 1000, 1000},
+	}
+
+	for _, test := range tests {
+		client, err := connectTo(t, test.query, test.heartBeat)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if client.connection.heartBeatClient != test.client || client.connection.heartBeatServer != test.server {
+			t.Errorf("%s: negotiated %d,%d instead of %d,%d", test.name,
+				client.connection.heartBeatClient, client.connection.heartBeatServer, test.client, test.server)
+		}
+	}
+}
+
+func TestHeartBeatRejectsInvalidHeader(t *testing.T) {
+	for _, value := range []string{"1000", "1000,1000,1000", "", "a,1000", "1000,-1"} {
+		_, err := connectTo(t, "?heart-beat=1000,1000", &value)
+		if err == nil {
+			t.Errorf("heart-beat %q of CONNECTED is accepted", value)
+		}
+	}
+}
+
+func TestHeartBeatRejectsInvalidDSN(t *testing.T) {
+	for _, value := range []string{"1000", "1000,", "1000,1000,1000", "x,1000", "-5,1000"} {
+		_, err := NewClient("tcp://localhost:61613?heart-beat=" + value)
+		if err == nil {
+			t.Errorf("heart-beat %q of the DSN is accepted", value)
+		}
+	}
+}
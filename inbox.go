@@ -0,0 +1,144 @@
+package gostomp
+
+import (
+	"context"
+	"github.com/msidorenko/gostomp/frame"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//inboxSize is the number of MESSAGE frames the reader reads ahead of the delivery to subscriptions
+const inboxSize = 64
+
+//inbox hands MESSAGE frames from the reader to the delivery goroutine of the connection.
+//Delivery may wait for flow control, the reader stops reading the socket meanwhile
+//unless somebody waits for a receipt, so RECEIPT and ERROR frames are never held by a full window.
+type inbox struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	frames []*frame.Frame
+	//delivering is set while a frame taken from the queue is dispatched
+	delivering bool
+	//waiting is set while the reader does not read the socket
+	waiting atomic.Bool
+	//closing is set when the connection is closed, the reader does not wait anymore
+	closing bool
+	//closed is set by the reader when it stops, delivery ends when the queue is empty
+	closed bool
+}
+
+func newInbox() *inbox {
+	inbox := &inbox{}
+	inbox.cond = sync.NewCond(&inbox.mutex)
+	return inbox
+}
+
+//awaitReading wait while delivery is paused by flow control or the queue is full, unless a receipt is expected
+func (client *Client) awaitReading(inbox *inbox) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	for !inbox.closing && (client.flowPaused.Load() || len(inbox.frames) >= inboxSize) && !client.receiptsPending() {
+		inbox.waiting.Store(true)
+		inbox.cond.Wait()
+	}
+	if inbox.waiting.Load() {
+		//the server was not read meanwhile, heart-beat monitoring starts over
+		client.lastReceived.Store(time.Now().UnixNano())
+		inbox.waiting.Store(false)
+	}
+}
+
+//wakeReader make the reader check again whether it may read, e.g. a receipt is expected now
+func (client *Client) wakeReader() {
+	inbox := client.inbox.Load()
+	if inbox == nil {
+		return
+	}
+
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	inbox.cond.Broadcast()
+}
+
+//deliverLoop pass MESSAGE frames of the connection to subscriptions in the order they were read
+func (client *Client) deliverLoop(inbox *inbox) {
+	for {
+		frm, ok := inbox.next()
+		if !ok {
+			return
+		}
+		client.transferFrameToSubscriptions(frm)
+	}
+}
+
+func (inbox *inbox) push(frm *frame.Frame) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	inbox.frames = append(inbox.frames, frm)
+	inbox.cond.Broadcast()
+}
+
+//next mark the previous frame as delivered and wait for the next one.
+//It returns false when the reader stopped and all frames are delivered.
+func (inbox *inbox) next() (*frame.Frame, bool) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	inbox.delivering = false
+	inbox.cond.Broadcast()
+	for len(inbox.frames) == 0 && !inbox.closed {
+		inbox.cond.Wait()
+	}
+	if len(inbox.frames) == 0 {
+		return nil, false
+	}
+
+	frm := inbox.frames[0]
+	inbox.frames[0] = nil
+	inbox.frames = inbox.frames[1:]
+	inbox.delivering = true
+	return frm, true
+}
+
+//stop wake up the reader for good, so it notices the closed socket
+func (inbox *inbox) stop() {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	inbox.closing = true
+	inbox.cond.Broadcast()
+}
+
+//close is called by the reader when it stops, no frames are pushed afterwards
+func (inbox *inbox) close() {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+
+	inbox.closing = true
+	inbox.closed = true
+	inbox.cond.Broadcast()
+}
+
+//awaitIdle wait until all frames read so far are handed to subscriptions or ctx is done
+func (inbox *inbox) awaitIdle(ctx context.Context) error {
+	//cond cannot wait for ctx, wake it up when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		inbox.mutex.Lock()
+		defer inbox.mutex.Unlock()
+		inbox.cond.Broadcast()
+	})
+	defer stop()
+
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	for len(inbox.frames) > 0 || inbox.delivering {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		inbox.cond.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package gostomp
+
+import (
+	"context"
+	"github.com/msidorenko/gostomp/frame"
+	"log/slog"
+	"sort"
+)
+
+//LevelTrace is the level of frame-level TX/RX records, it is below slog.LevelDebug
+const LevelTrace = slog.LevelDebug - 4
+
+//DefaultTraceBodyLimit is the number of body bytes written to a frame trace record
+const DefaultTraceBodyLimit = 256
+
+//WithLogHandler route all client diagnostics to the handler.
+//By default records go to slog.Default().
+func WithLogHandler(handler slog.Handler) ClientOption {
+	return func(client *Client) {
+		client.logger = slog.New(handler)
+	}
+}
+
+//WithFrameTrace enable logging of every sent and received frame at LevelTrace.
+//Frame bodies are truncated to bodyLimit bytes, zero means DefaultTraceBodyLimit, a negative value omits bodies.
+//Values of frame.RedactedHeaders are never logged.
+func WithFrameTrace(bodyLimit int) ClientOption {
+	return func(client *Client) {
+		if bodyLimit == 0 {
+			bodyLimit = DefaultTraceBodyLimit
+		}
+		client.frameTrace = true
+		client.traceBodyLimit = bodyLimit
+	}
+}
+
+//traceFrame write TX/RX record of the frame if frame trace mode is enabled
+func (client *Client) traceFrame(direction string, frm *frame.Frame) {
+	if !client.frameTrace {
+		return
+	}
+
+	ctx := context.Background()
+	if !client.logger.Enabled(ctx, LevelTrace) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("command", frm.Command),
+		slog.Any("headers", redactedHeaders(frm.Headers)),
+	}
+
+	if client.traceBodyLimit > 0 && len(frm.Body) > 0 {
+		body := frm.Body
+		if len(body) > client.traceBodyLimit {
+			body = body[:client.traceBodyLimit]
+			attrs = append(attrs, slog.Int("body_size", len(frm.Body)))
+		}
+		attrs = append(attrs, slog.String("body", string(body)))
+	}
+
+	client.logger.LogAttrs(ctx, LevelTrace, direction, attrs...)
+}
+
+//redactedHeaders convert frame headers to sorted attributes with masked secrets
+func redactedHeaders(headers map[string]string) slog.Value {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, key := range keys {
+		value := headers[key]
+		if frame.RedactedHeaders[key] {
+			value = "***"
+		}
+		attrs = append(attrs, slog.String(key, value))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+//subscriptionAttrs returns attributes which identify the subscription in log records
+func subscriptionAttrs(subscription *Subscription) []any {
+	return []any{
+		slog.String("subscription", subscription.GetID()),
+		slog.String("destination", subscription.Destination),
+	}
+}
@@ -0,0 +1,129 @@
+package message
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strings"
+	"sync"
+)
+
+//Codec converts values to message bodies of a single content type
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecs      = make(map[string]Codec)
+	codecsMutex sync.RWMutex
+)
+
+//JSON codec uses encoding/json with application/json content type
+var JSON Codec = jsonCodec{}
+
+//Gob codec uses encoding/gob with application/x-gob content type
+var Gob Codec = gobCodec{}
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Gob)
+}
+
+//RegisterCodec make codec available for Decode, a codec registered earlier for the same content type is replaced
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	codecs[normalizeContentType(codec.ContentType())] = codec
+}
+
+//CodecFor returns the codec registered for contentType, parameters like charset are ignored
+func CodecFor(contentType string) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[normalizeContentType(contentType)]
+	if !ok {
+		return nil, errors.New("Codec for content type '" + contentType + "' is not registered")
+	}
+	return codec, nil
+}
+
+//NewWithValue create message with v encoded by codec as the body and content-type header of the codec
+func NewWithValue(v interface{}, codec Codec) (*Message, error) {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := New(body)
+	msg.SetContentType(codec.ContentType())
+	return msg, nil
+}
+
+//Decode unmarshal the body into v with the codec registered for content-type header of the message
+func (message *Message) Decode(v interface{}) error {
+	contentType, err := message.GetHeader(ContentType)
+	if err != nil {
+		return err
+	}
+
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(message.body, v)
+}
+
+func (message *Message) SetContentType(contentType string) {
+	message.headers[ContentType] = contentType
+}
+
+func (message *Message) GetContentType() string {
+	return message.headers[ContentType]
+}
+
+func normalizeContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
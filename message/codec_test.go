@@ -0,0 +1,140 @@
+package message
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type order struct {
+	Id     string
+	Amount int
+	Tags   []string
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    Codec
+	}{
+		{"application/json", JSON},
+		{"application/json; charset=utf-8", JSON},
+		{" Application/JSON ", JSON},
+		{"application/x-gob", Gob},
+		{"text/plain", nil},
+		{"", nil},
+		{"application/json;;", nil},
+	}
+
+	for _, test := range tests {
+		codec, err := CodecFor(test.contentType)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got codec %s", test.contentType, codec.ContentType())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.contentType, err)
+			continue
+		}
+		if codec != test.expected {
+			t.Errorf("%q: got codec %s", test.contentType, codec.ContentType())
+		}
+	}
+}
+
+func TestNewWithValueDecodes(t *testing.T) {
+	value := order{Id: "o-1", Amount: 42, Tags: []string{"express"}}
+
+	for _, codec := range []Codec{JSON, Gob} {
+		msg, err := NewWithValue(value, codec)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.ContentType(), err)
+		}
+		if contentType := msg.GetContentType(); contentType != codec.ContentType() {
+			t.Fatalf("%s: content-type header is %q", codec.ContentType(), contentType)
+		}
+
+		var decoded order
+		err = msg.Decode(&decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.ContentType(), err)
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Fatalf("%s: decoded %+v instead of %+v", codec.ContentType(), decoded, value)
+		}
+	}
+}
+
+func TestNewWithValueMarshalError(t *testing.T) {
+	_, err := NewWithValue(make(chan int), JSON)
+	if err == nil {
+		t.Fatal("value which cannot be marshalled is accepted")
+	}
+}
+
+func TestDecodeRejectsBadInput(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"no content-type", "", `{"Id":"o-1"}`},
+		{"unknown content-type", "text/csv", "o-1,42"},
+		{"broken json", "application/json", `{"Id":`},
+		{"wrong json type", "application/json", `{"Amount":"many"}`},
+		{"broken gob", "application/x-gob", "\x01\x02\x03"},
+		{"empty gob", "application/x-gob", ""},
+	}
+
+	for _, test := range tests {
+		msg := New([]byte(test.body))
+		if test.contentType != "" {
+			msg.SetContentType(test.contentType)
+		}
+		var decoded order
+		err := msg.Decode(&decoded)
+		if err == nil {
+			t.Errorf("%s: decoded %+v", test.name, decoded)
+		}
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) ContentType() string {
+	return "text/x-upper"
+}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = strings.ToLower(string(data))
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	msg := New([]byte("HELLO"))
+	msg.SetContentType("text/x-upper; charset=us-ascii")
+	var decoded string
+	if err := msg.Decode(&decoded); err == nil {
+		t.Fatal("decoded with a codec which is not registered")
+	}
+
+	RegisterCodec(upperCodec{})
+	t.Cleanup(func() {
+		codecsMutex.Lock()
+		defer codecsMutex.Unlock()
+		delete(codecs, "text/x-upper")
+	})
+	err := msg.Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "hello" {
+		t.Fatalf("unexpected value %q", decoded)
+	}
+}
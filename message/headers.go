@@ -0,0 +1,160 @@
+package message
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+//Clone returns a deep copy of the message, so changes of headers or body
+//do not affect the original message and the frame it was received with
+func (message *Message) Clone() *Message {
+	headers := make(map[string]string, len(message.headers))
+	for key, value := range message.headers {
+		headers[key] = value
+	}
+
+	var body []byte
+	if message.body != nil {
+		body = make([]byte, len(message.body))
+		copy(body, message.body)
+	}
+
+	return &Message{
+		headers: headers,
+		body:    body,
+		ctx:     message.ctx,
+	}
+}
+
+//SetExpires set the time after which the broker discards the message, zero time means never
+func (message *Message) SetExpires(expires time.Time) {
+	if expires.IsZero() {
+		message.headers[Expires] = "0"
+		return
+	}
+	message.headers[Expires] = strconv.FormatInt(expires.UnixMilli(), 10)
+}
+
+//GetExpires returns zero time if the message never expires
+func (message *Message) GetExpires() (time.Time, error) {
+	return message.getMillisTime(Expires)
+}
+
+//SetTimestamp set the time the message was handed to the broker
+func (message *Message) SetTimestamp(timestamp time.Time) {
+	message.headers[TimeStamp] = strconv.FormatInt(timestamp.UnixMilli(), 10)
+}
+
+func (message *Message) GetTimestamp() (time.Time, error) {
+	return message.getMillisTime(TimeStamp)
+}
+
+//SetPriority set JMS priority from 0 (lowest) to 9 (highest)
+func (message *Message) SetPriority(priority int) {
+	message.headers[Priority] = strconv.Itoa(priority)
+}
+
+func (message *Message) GetPriority() (int, error) {
+	return message.getInt(Priority)
+}
+
+//GetRedelivered reports whether the broker has delivered the message before
+func (message *Message) GetRedelivered() (bool, error) {
+	value, err := message.GetHeader(Redelivered)
+	if err != nil {
+		return false, err
+	}
+	redelivered, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("Header '" + Redelivered + "' is not a boolean: " + value)
+	}
+	return redelivered, nil
+}
+
+func (message *Message) SetType(messageType string) {
+	message.headers[Type] = messageType
+}
+
+func (message *Message) GetType() string {
+	return message.headers[Type]
+}
+
+//SetGroupID set JMSXGroupID, messages of a group are delivered to a single consumer in order
+func (message *Message) SetGroupID(groupId string) {
+	message.headers[GroupId] = groupId
+}
+
+func (message *Message) GetGroupID() string {
+	return message.headers[GroupId]
+}
+
+func (message *Message) SetGroupSeq(seq int) {
+	message.headers[GroupSeq] = strconv.Itoa(seq)
+}
+
+func (message *Message) GetGroupSeq() (int, error) {
+	return message.getInt(GroupSeq)
+}
+
+//SetTTL set x-message-ttl used by RabbitMQ queues
+func (message *Message) SetTTL(ttl time.Duration) {
+	message.headers[MessageTTL] = strconv.FormatInt(ttl.Milliseconds(), 10)
+}
+
+func (message *Message) GetTTL() (time.Duration, error) {
+	return message.getMillisDuration(MessageTTL)
+}
+
+//SetExpiration set RabbitMQ per-message TTL
+func (message *Message) SetExpiration(expiration time.Duration) {
+	message.headers[Expiration] = strconv.FormatInt(expiration.Milliseconds(), 10)
+}
+
+func (message *Message) GetExpiration() (time.Duration, error) {
+	return message.getMillisDuration(Expiration)
+}
+
+func (message *Message) GetDelay() (time.Duration, error) {
+	return message.getMillisDuration(Delay)
+}
+
+func (message *Message) getInt(key string) (int, error) {
+	value, err := message.GetHeader(key)
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("Header '" + key + "' is not an integer: " + value)
+	}
+	return number, nil
+}
+
+//getMillisTime parse header with milliseconds since epoch, 0 is returned as zero time
+func (message *Message) getMillisTime(key string) (time.Time, error) {
+	value, err := message.GetHeader(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("Header '" + key + "' is not a timestamp: " + value)
+	}
+	if millis == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(millis), nil
+}
+
+func (message *Message) getMillisDuration(key string) (time.Duration, error) {
+	value, err := message.GetHeader(key)
+	if err != nil {
+		return 0, err
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("Header '" + key + "' is not a duration in milliseconds: " + value)
+	}
+	return time.Duration(millis) * time.Millisecond, nil
+}
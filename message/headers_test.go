@@ -0,0 +1,142 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypedHeaderGetters(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		get    func(msg *Message) (interface{}, error)
+		//expected is nil when the getter must fail
+		expected interface{}
+	}{
+		{"priority", Priority, "7", getPriority, 7},
+		{"negative priority", Priority, "-1", getPriority, -1},
+		{"priority not a number", Priority, "high", getPriority, nil},
+		{"priority empty", Priority, "", getPriority, nil},
+		{"group seq", GroupSeq, "3", getGroupSeq, 3},
+		{"group seq overflow", GroupSeq, "99999999999999999999", getGroupSeq, nil},
+		{"redelivered", Redelivered, "true", getRedelivered, true},
+		{"not redelivered", Redelivered, "false", getRedelivered, false},
+		{"redelivered not a boolean", Redelivered, "yes", getRedelivered, nil},
+		{"timestamp", TimeStamp, "1700000000123", getTimestamp, time.UnixMilli(1700000000123)},
+		{"timestamp not a number", TimeStamp, "2023-11-14", getTimestamp, nil},
+		{"never expires", Expires, "0", getExpires, time.Time{}},
+		{"expires", Expires, "1700000000000", getExpires, time.UnixMilli(1700000000000)},
+		{"expires fraction", Expires, "1.5", getExpires, nil},
+		{"ttl", MessageTTL, "1500", getTTL, 1500 * time.Millisecond},
+		{"ttl with unit", MessageTTL, "1500ms", getTTL, nil},
+		{"expiration", Expiration, "60000", getExpiration, time.Minute},
+		{"delay", Delay, "250", getDelay, 250 * time.Millisecond},
+		{"delay not a number", Delay, " 250", getDelay, nil},
+	}
+
+	for _, test := range tests {
+		msg := New(nil)
+		msg.SetHeader(test.header, test.value)
+		value, err := test.get(msg)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: %q is accepted as %v", test.name, test.value, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if expectedTime, ok := test.expected.(time.Time); ok {
+			if !value.(time.Time).Equal(expectedTime) {
+				t.Errorf("%s: got %v instead of %v", test.name, value, expectedTime)
+			}
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%s: got %v instead of %v", test.name, value, test.expected)
+		}
+	}
+}
+
+func TestTypedHeaderGettersMissingHeader(t *testing.T) {
+	msg := New(nil)
+	for name, get := range map[string]func(msg *Message) (interface{}, error){
+		"priority":    getPriority,
+		"group seq":   getGroupSeq,
+		"redelivered": getRedelivered,
+		"timestamp":   getTimestamp,
+		"expires":     getExpires,
+		"ttl":         getTTL,
+		"expiration":  getExpiration,
+		"delay":       getDelay,
+	} {
+		if _, err := get(msg); err == nil {
+			t.Errorf("%s: missing header is accepted", name)
+		}
+	}
+}
+
+func TestTypedHeaderSetters(t *testing.T) {
+	msg := New(nil)
+	msg.SetPriority(9)
+	msg.SetGroupSeq(2)
+	msg.SetTimestamp(time.UnixMilli(1700000000123))
+	msg.SetExpires(time.Time{})
+	msg.SetTTL(90 * time.Second)
+	msg.SetExpiration(1500 * time.Microsecond)
+	msg.SetType("order")
+	msg.SetGroupID("customer-1")
+
+	expected := map[string]string{
+		Priority:   "9",
+		GroupSeq:   "2",
+		TimeStamp:  "1700000000123",
+		Expires:    "0",
+		MessageTTL: "90000",
+		Expiration: "1",
+		Type:       "order",
+		GroupId:    "customer-1",
+	}
+	for key, value := range expected {
+		if header := msg.GetHeaders()[key]; header != value {
+			t.Errorf("%s: got %q instead of %q", key, header, value)
+		}
+	}
+	if msg.GetType() != "order" || msg.GetGroupID() != "customer-1" {
+		t.Errorf("unexpected type %q or group %q", msg.GetType(), msg.GetGroupID())
+	}
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	msg := New([]byte("order"))
+	msg.SetDestination("/queue/orders")
+
+	clone := msg.Clone()
+	clone.SetDestination("/queue/other")
+	clone.GetBody()[0] = 'O'
+
+	if msg.GetDestination() != "/queue/orders" {
+		t.Fatalf("header of the original changed to %s", msg.GetDestination())
+	}
+	if string(msg.GetBody()) != "order" {
+		t.Fatalf("body of the original changed to %s", msg.GetBody())
+	}
+	if clone.GetID() != msg.GetID() {
+		t.Fatal("clone has another message-id")
+	}
+	if New(nil).Clone().GetBody() != nil {
+		t.Fatal("clone of a message without body has a body")
+	}
+}
+
+func getPriority(msg *Message) (interface{}, error)    { return msg.GetPriority() }
+func getGroupSeq(msg *Message) (interface{}, error)    { return msg.GetGroupSeq() }
+func getRedelivered(msg *Message) (interface{}, error) { return msg.GetRedelivered() }
+func getTimestamp(msg *Message) (interface{}, error)   { return msg.GetTimestamp() }
+func getExpires(msg *Message) (interface{}, error)     { return msg.GetExpires() }
+func getTTL(msg *Message) (interface{}, error)         { return msg.GetTTL() }
+func getExpiration(msg *Message) (interface{}, error)  { return msg.GetExpiration() }
+func getDelay(msg *Message) (interface{}, error)       { return msg.GetDelay() }
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"context"
 	"errors"
 	"github.com/google/uuid"
 	"github.com/msidorenko/gostomp/frame"
@@ -14,6 +15,7 @@ const (
 	Login     = "login"
 	Passcode  = "passcode"
 	Heartbeat = "heart-beat"
+	ClientId  = "client-id"
 
 	ContentLength = "content-length"
 	ContentType   = "content-type"
@@ -28,18 +30,38 @@ const (
 	MessageId     = "message-id"
 	Message_      = "message"
 	Receipt       = "receipt"
-	TimeStamp     = "timestamp "
+	TimeStamp     = "timestamp"
+	Transaction   = "transaction"
 
 	//ActiveMQ specific
 	ReplyTo       = "reply-to"
 	CorrelationId = "correlation-id"
 	Persistent    = "persistent"
 	Delay         = "AMQ_SCHEDULED_DELAY"
+	Expires       = "expires"
+	Priority      = "priority"
+	Redelivered   = "redelivered"
+	Type          = "type"
+	GroupId       = "JMSXGroupID"
+	GroupSeq      = "JMSXGroupSeq"
+
+	//ActiveMQ scheduler
+	ScheduledPeriod = "AMQ_SCHEDULED_PERIOD"
+	ScheduledRepeat = "AMQ_SCHEDULED_REPEAT"
+	ScheduledCron   = "AMQ_SCHEDULED_CRON"
+
+	//RabbitMQ specific
+	Expiration = "expiration"
+	MessageTTL = "x-message-ttl"
+
+	//Set by gostomp when the body is compressed
+	ContentEncoding = "content-encoding"
 )
 
 type Message struct {
 	headers map[string]string
 	body    []byte
+	ctx     context.Context
 }
 
 func NewFromFrame(frm *frame.Frame) *Message {
@@ -128,6 +150,7 @@ func (message *Message) GetDestination() string {
 	return message.headers[Destination]
 }
 
+//SetDelay set ActiveMQ scheduled delay, Dialect.SetDelay and Client.Schedule work with other brokers as well
 func (message *Message) SetDelay(delay time.Duration) {
 	message.headers[Delay] = strconv.FormatInt(delay.Milliseconds(), 10)
 }
@@ -144,3 +167,36 @@ func (message *Message) GetCorrelationId() string {
 	}
 
 }
+
+//Context returns the context of the message.
+//For received messages it carries the trace context extracted from headers.
+func (message *Message) Context() context.Context {
+	if message.ctx == nil {
+		return context.Background()
+	}
+	return message.ctx
+}
+
+//SetContext attach ctx to the message, Producer uses it as parent for trace propagation
+func (message *Message) SetContext(ctx context.Context) {
+	message.ctx = ctx
+}
+
+//HeaderCarrier adapts message headers to a text map carrier used by trace context propagators
+type HeaderCarrier map[string]string
+
+func (carrier HeaderCarrier) Get(key string) string {
+	return carrier[key]
+}
+
+func (carrier HeaderCarrier) Set(key, value string) {
+	carrier[key] = value
+}
+
+func (carrier HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,40 @@
+//Package protobuf registers protocol buffers codec for message.Message bodies.
+//Import it for side effects to make msg.Decode understand application/x-protobuf.
+package protobuf
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"google.golang.org/protobuf/proto"
+)
+
+const ContentType = "application/x-protobuf"
+
+//Codec marshals values implementing proto.Message
+var Codec message.Codec = codec{}
+
+func init() {
+	message.RegisterCodec(Codec)
+}
+
+type codec struct{}
+
+func (codec) ContentType() string {
+	return ContentType
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("protobuf codec: value does not implement proto.Message")
+	}
+	return proto.Marshal(msg)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return errors.New("protobuf codec: value does not implement proto.Message")
+	}
+	return proto.Unmarshal(data, msg)
+}
@@ -0,0 +1,43 @@
+package protobuf
+
+import (
+	"github.com/msidorenko/gostomp/message"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+func TestDecodeProtobuf(t *testing.T) {
+	msg, err := message.NewWithValue(wrapperspb.String("order"), Codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetContentType() != ContentType {
+		t.Fatalf("unexpected content type %q", msg.GetContentType())
+	}
+
+	var decoded wrapperspb.StringValue
+	err = msg.Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.GetValue() != "order" {
+		t.Fatalf("unexpected value %q", decoded.GetValue())
+	}
+}
+
+func TestProtobufRejectsBadInput(t *testing.T) {
+	if _, err := message.NewWithValue("order", Codec); err == nil {
+		t.Fatal("value which is not a proto.Message is marshalled")
+	}
+
+	msg := message.New([]byte{0xff, 0xff, 0xff})
+	msg.SetContentType(ContentType)
+	var decoded wrapperspb.StringValue
+	if err := msg.Decode(&decoded); err == nil {
+		t.Fatal("broken body is decoded")
+	}
+	var text string
+	if err := msg.Decode(&text); err == nil {
+		t.Fatal("body is decoded into a value which is not a proto.Message")
+	}
+}
@@ -0,0 +1,49 @@
+package gostomp
+
+import "time"
+
+// Metrics receives instrumentation events of the Client.
+// Implementations must be safe for concurrent use and must not block.
+type Metrics interface {
+	//FrameSent is called after a frame has been written to the socket
+	FrameSent(command string, bytes int)
+	//FrameReceived is called for every frame read from the socket, heart-beats excluded
+	FrameReceived(command string, bytes int)
+	//MessageSent is called after Producer has sent a message
+	MessageSent(destination string)
+	//MessageReceived is called for every MESSAGE frame dispatched to a subscription of the destination.
+	//Consumer events are keyed by the destination and the name of the subscription, see Subscription.Name.
+	MessageReceived(destination, subscription string)
+	//Acked and Nacked are called after ACK or NACK frame has been sent for a subscription of the destination
+	Acked(destination, subscription string)
+	Nacked(destination, subscription string)
+	//ReceiptLatency is the time between sending a DELIVERY_SYNC message and getting its RECEIPT
+	ReceiptLatency(latency time.Duration)
+	//Reconnected is called when the client connects again after a previous connection
+	Reconnected()
+	//HeartbeatMissed is called when the server did not send anything within the negotiated heart-beat interval
+	HeartbeatMissed()
+	//DispatchInFlight is called with +1 when a subscription callback starts and with -1 when it returns
+	DispatchInFlight(delta int)
+}
+
+// WithMetrics set the receiver of client instrumentation events
+func WithMetrics(metrics Metrics) ClientOption {
+	return func(client *Client) {
+		client.metrics = metrics
+	}
+}
+
+// noopMetrics is used when no Metrics is configured
+type noopMetrics struct{}
+
+func (noopMetrics) FrameSent(string, int)          {}
+func (noopMetrics) FrameReceived(string, int)      {}
+func (noopMetrics) MessageSent(string)             {}
+func (noopMetrics) MessageReceived(string, string) {}
+func (noopMetrics) Acked(string, string)           {}
+func (noopMetrics) Nacked(string, string)          {}
+func (noopMetrics) ReceiptLatency(time.Duration)   {}
+func (noopMetrics) Reconnected()                   {}
+func (noopMetrics) HeartbeatMissed()               {}
+func (noopMetrics) DispatchInFlight(int)           {}
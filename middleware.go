@@ -0,0 +1,55 @@
+package gostomp
+
+import "github.com/msidorenko/gostomp/message"
+
+//SendFunc sends the message to the Message Broker, see Client.Producer
+type SendFunc func(msg *message.Message, deliveryMode bool) error
+
+//SendMiddleware wraps sending of outgoing messages before they are converted to SEND frames
+type SendMiddleware func(next SendFunc) SendFunc
+
+//ConsumeMiddleware wraps the callback of a subscription
+type ConsumeMiddleware func(next SubscriptionCallback) SubscriptionCallback
+
+//WithSendMiddleware register middleware for every message sent by Producer.
+//The first registered middleware is the outermost one.
+func WithSendMiddleware(middleware ...SendMiddleware) ClientOption {
+	return func(client *Client) {
+		client.sendMiddleware = append(client.sendMiddleware, middleware...)
+	}
+}
+
+//WithConsumeMiddleware register middleware for callbacks of all subscriptions.
+//Client middleware wraps the middleware of the subscription, the first registered is the outermost one.
+func WithConsumeMiddleware(middleware ...ConsumeMiddleware) ClientOption {
+	return func(client *Client) {
+		client.consumeMiddleware = append(client.consumeMiddleware, middleware...)
+	}
+}
+
+//sendChain wrap send with all registered send middleware.
+//Transport features are applied after user middleware, right before framing:
+//the body is compressed first and then encrypted and signed.
+func (client *Client) sendChain(send SendFunc) SendFunc {
+	send = client.sealMiddleware(send)
+	send = client.compressMiddleware(send)
+	for i := len(client.sendMiddleware) - 1; i >= 0; i-- {
+		send = client.sendMiddleware[i](send)
+	}
+	return send
+}
+
+//consumeChain wrap the subscription callback with subscription and client middleware.
+//Transport features are applied before any user middleware in reverse order of sending.
+func (client *Client) consumeChain(subscription *Subscription) SubscriptionCallback {
+	callback := subscription.Callback
+	for i := len(subscription.Middleware) - 1; i >= 0; i-- {
+		callback = subscription.Middleware[i](callback)
+	}
+	for i := len(client.consumeMiddleware) - 1; i >= 0; i-- {
+		callback = client.consumeMiddleware[i](callback)
+	}
+	callback = client.decompressMiddleware(callback)
+	callback = client.openMiddleware(callback)
+	return callback
+}
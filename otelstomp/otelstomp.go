@@ -0,0 +1,69 @@
+//Package otelstomp connects gostomp trace propagation hooks to OpenTelemetry
+package otelstomp
+
+import (
+	"context"
+	"github.com/msidorenko/gostomp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type propagator struct {
+	propagator propagation.TextMapPropagator
+}
+
+//Propagator adapts an OpenTelemetry propagator, e.g. propagation.TraceContext{} or otel.GetTextMapPropagator()
+func Propagator(p propagation.TextMapPropagator) gostomp.TextMapPropagator {
+	return &propagator{propagator: p}
+}
+
+func (p *propagator) Inject(ctx context.Context, carrier gostomp.TextMapCarrier) {
+	p.propagator.Inject(ctx, carrier)
+}
+
+func (p *propagator) Extract(ctx context.Context, carrier gostomp.TextMapCarrier) context.Context {
+	return p.propagator.Extract(ctx, carrier)
+}
+
+func (p *propagator) Fields() []string {
+	return p.propagator.Fields()
+}
+
+type tracer struct {
+	tracer trace.Tracer
+}
+
+//Tracer adapts an OpenTelemetry tracer, e.g. otel.Tracer("gostomp")
+func Tracer(t trace.Tracer) gostomp.Tracer {
+	return &tracer{tracer: t}
+}
+
+func (t *tracer) Start(ctx context.Context, name string, kind gostomp.SpanKind, attrs map[string]string) (context.Context, gostomp.Span) {
+	spanKind := trace.SpanKindProducer
+	if kind == gostomp.SpanKindConsumer {
+		spanKind = trace.SpanKindConsumer
+	}
+
+	attributes := make([]attribute.KeyValue, 0, len(attrs))
+	for key, value := range attrs {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+
+	ctx, otelSpan := t.tracer.Start(ctx, name, trace.WithSpanKind(spanKind), trace.WithAttributes(attributes...))
+	return ctx, &span{span: otelSpan}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s *span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *span) End() {
+	s.span.End()
+}
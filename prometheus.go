@@ -0,0 +1,205 @@
+package gostomp
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultLatencyBuckets are upper bounds in seconds of the receipt latency histogram
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//PrometheusMetrics collects client metrics in memory and exposes them in Prometheus text format.
+//It does not depend on the Prometheus client library: serve it as http.Handler
+//or call WriteTo from your own collector.
+type PrometheusMetrics struct {
+	mutex     sync.Mutex
+	namespace string
+	counters  map[string]*promSeries
+	gauges    map[string]*promSeries
+	latency   promHistogram
+}
+
+//promSeries is a metric family, values are keyed by rendered labels
+type promSeries struct {
+	help   string
+	values map[string]float64
+}
+
+type promHistogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+//NewPrometheusMetrics create collector with metric names prefixed by namespace, "gostomp" if empty
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "gostomp"
+	}
+
+	return &PrometheusMetrics{
+		namespace: namespace,
+		counters:  make(map[string]*promSeries),
+		gauges:    make(map[string]*promSeries),
+		latency: promHistogram{
+			buckets: DefaultLatencyBuckets,
+			counts:  make([]uint64, len(DefaultLatencyBuckets)),
+		},
+	}
+}
+
+func (m *PrometheusMetrics) FrameSent(command string, bytes int) {
+	m.add(m.counters, "frames_sent_total", "Frames sent to the broker.", 1, "command", command)
+	m.add(m.counters, "bytes_sent_total", "Bytes sent to the broker.", float64(bytes), "command", command)
+}
+
+func (m *PrometheusMetrics) FrameReceived(command string, bytes int) {
+	m.add(m.counters, "frames_received_total", "Frames received from the broker.", 1, "command", command)
+	m.add(m.counters, "bytes_received_total", "Bytes received from the broker.", float64(bytes), "command", command)
+}
+
+func (m *PrometheusMetrics) MessageSent(destination string) {
+	m.add(m.counters, "messages_sent_total", "Messages sent by Producer.", 1, "destination", destination)
+}
+
+func (m *PrometheusMetrics) MessageReceived(destination, subscription string) {
+	m.add(m.counters, "messages_received_total", "Messages dispatched to subscriptions.", 1, "destination", destination, "subscription", subscription)
+}
+
+func (m *PrometheusMetrics) Acked(destination, subscription string) {
+	m.add(m.counters, "acks_total", "ACK frames sent.", 1, "destination", destination, "subscription", subscription)
+}
+
+func (m *PrometheusMetrics) Nacked(destination, subscription string) {
+	m.add(m.counters, "nacks_total", "NACK frames sent.", 1, "destination", destination, "subscription", subscription)
+}
+
+func (m *PrometheusMetrics) ReceiptLatency(latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	seconds := latency.Seconds()
+	for i, bound := range m.latency.buckets {
+		if seconds <= bound {
+			m.latency.counts[i]++
+		}
+	}
+	m.latency.sum += seconds
+	m.latency.count++
+}
+
+func (m *PrometheusMetrics) Reconnected() {
+	m.add(m.counters, "reconnects_total", "Connections established after the first one.", 1)
+}
+
+func (m *PrometheusMetrics) HeartbeatMissed() {
+	m.add(m.counters, "heartbeat_misses_total", "Server heart-beats that did not arrive in time.", 1)
+}
+
+func (m *PrometheusMetrics) DispatchInFlight(delta int) {
+	m.add(m.gauges, "dispatch_in_flight", "Subscription callbacks currently running.", float64(delta))
+}
+
+func (m *PrometheusMetrics) add(family map[string]*promSeries, name, help string, value float64, labels ...string) {
+	key := renderLabels(labels)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series, ok := family[name]
+	if !ok {
+		series = &promSeries{help: help, values: make(map[string]float64)}
+		family[name] = series
+	}
+	series.values[key] += value
+}
+
+//WriteTo write all collected metrics to w in Prometheus text exposition format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counter := &countingWriter{writer: w}
+	buf := bufio.NewWriter(counter)
+
+	m.writeFamily(buf, m.counters, "counter")
+	m.writeFamily(buf, m.gauges, "gauge")
+
+	name := m.namespace + "_receipt_latency_seconds"
+	buf.WriteString("# HELP " + name + " Time between sending a DELIVERY_SYNC message and getting its RECEIPT.\n")
+	buf.WriteString("# TYPE " + name + " histogram\n")
+	for i, bound := range m.latency.buckets {
+		buf.WriteString(name + "_bucket{le=\"" + formatFloat(bound) + "\"} " + strconv.FormatUint(m.latency.counts[i], 10) + "\n")
+	}
+	buf.WriteString(name + "_bucket{le=\"+Inf\"} " + strconv.FormatUint(m.latency.count, 10) + "\n")
+	buf.WriteString(name + "_sum " + formatFloat(m.latency.sum) + "\n")
+	buf.WriteString(name + "_count " + strconv.FormatUint(m.latency.count, 10) + "\n")
+
+	err := buf.Flush()
+	return counter.written, err
+}
+
+func (m *PrometheusMetrics) writeFamily(buf *bufio.Writer, family map[string]*promSeries, metricType string) {
+	names := make([]string, 0, len(family))
+	for name := range family {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		series := family[name]
+		fullName := m.namespace + "_" + name
+		buf.WriteString("# HELP " + fullName + " " + series.help + "\n")
+		buf.WriteString("# TYPE " + fullName + " " + metricType + "\n")
+
+		keys := make([]string, 0, len(series.values))
+		for key := range series.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buf.WriteString(fullName + key + " " + formatFloat(series.values[key]) + "\n")
+		}
+	}
+}
+
+//ServeHTTP expose metrics for scraping
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//renderLabels convert name/value pairs to {name="value",...}
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(labels[i])
+		builder.WriteString(`="`)
+		builder.WriteString(labelValueReplacer.Replace(labels[i+1]))
+		builder.WriteString(`"`)
+	}
+	builder.WriteString("}")
+	return builder.String()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
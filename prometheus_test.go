@@ -0,0 +1,90 @@
+package gostomp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusTextFormat(t *testing.T) {
+	metrics := NewPrometheusMetrics("")
+	metrics.FrameSent("SEND", 120)
+	metrics.MessageReceived("/queue/orders", "orders")
+	metrics.Acked("/queue/orders", "orders")
+	metrics.Acked("/queue/orders", "orders")
+	metrics.DispatchInFlight(1)
+	metrics.ReceiptLatency(20 * time.Millisecond)
+
+	var out strings.Builder
+	written, err := metrics.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP gostomp_acks_total ACK frames sent.
+# TYPE gostomp_acks_total counter
+gostomp_acks_total{destination="/queue/orders",subscription="orders"} 2
+# HELP gostomp_bytes_sent_total Bytes sent to the broker.
+# TYPE gostomp_bytes_sent_total counter
+gostomp_bytes_sent_total{command="SEND"} 120
+# HELP gostomp_frames_sent_total Frames sent to the broker.
+# TYPE gostomp_frames_sent_total counter
+gostomp_frames_sent_total{command="SEND"} 1
+# HELP gostomp_messages_received_total Messages dispatched to subscriptions.
+# TYPE gostomp_messages_received_total counter
+gostomp_messages_received_total{destination="/queue/orders",subscription="orders"} 1
+# HELP gostomp_dispatch_in_flight Subscription callbacks currently running.
+# TYPE gostomp_dispatch_in_flight gauge
+gostomp_dispatch_in_flight 1
+# HELP gostomp_receipt_latency_seconds Time between sending a DELIVERY_SYNC message and getting its RECEIPT.
+# TYPE gostomp_receipt_latency_seconds histogram
+gostomp_receipt_latency_seconds_bucket{le="0.005"} 0
+gostomp_receipt_latency_seconds_bucket{le="0.01"} 0
+gostomp_receipt_latency_seconds_bucket{le="0.025"} 1
+gostomp_receipt_latency_seconds_bucket{le="0.05"} 1
+gostomp_receipt_latency_seconds_bucket{le="0.1"} 1
+gostomp_receipt_latency_seconds_bucket{le="0.25"} 1
+gostomp_receipt_latency_seconds_bucket{le="0.5"} 1
+gostomp_receipt_latency_seconds_bucket{le="1"} 1
+gostomp_receipt_latency_seconds_bucket{le="2.5"} 1
+gostomp_receipt_latency_seconds_bucket{le="5"} 1
+gostomp_receipt_latency_seconds_bucket{le="10"} 1
+gostomp_receipt_latency_seconds_bucket{le="+Inf"} 1
+gostomp_receipt_latency_seconds_sum 0.02
+gostomp_receipt_latency_seconds_count 1
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	if written != int64(len(expected)) {
+		t.Fatalf("WriteTo reports %d bytes instead of %d", written, len(expected))
+	}
+}
+
+func TestPrometheusEscapesLabelValues(t *testing.T) {
+	metrics := NewPrometheusMetrics("app")
+	metrics.MessageSent("/queue/\"odd\"\\name\n")
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	line := `app_messages_sent_total{destination="/queue/\"odd\"\\name\n"} 1`
+	if !strings.Contains(recorder.Body.String(), line+"\n") {
+		t.Fatalf("escaped series %s is missing in:\n%s", line, recorder.Body.String())
+	}
+}
+
+func TestSubscriptionMetricsName(t *testing.T) {
+	subscription := &Subscription{id: "3f1c"}
+	if name := subscription.metricsName(); name != "3f1c" {
+		t.Fatalf("expected the id without Name, got %q", name)
+	}
+	subscription.Name = "orders"
+	if name := subscription.metricsName(); name != "orders" {
+		t.Fatalf("expected Name, got %q", name)
+	}
+}
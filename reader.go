@@ -17,13 +17,19 @@ const (
 )
 
 type Reader struct {
-	reader *bufio.Reader
+	reader    *bufio.Reader
+	bytesRead int64
 }
 
 func NewReader(reader io.Reader, bufferSize int) *Reader {
 	return &Reader{reader: bufio.NewReaderSize(reader, bufferSize)}
 }
 
+//BytesRead returns the number of bytes consumed by all frames and heart-beats read so far
+func (r *Reader) BytesRead() int64 {
+	return r.bytesRead
+}
+
 func (r *Reader) Read() (*frame.Frame, error) {
 	cmd, err := r.readLine()
 	if err != nil {
@@ -70,7 +76,6 @@ func (r *Reader) Read() (*frame.Frame, error) {
 		}
 
 		frm.AddHeader(headerKey, headerValue)
-		//println(headerKey, ":", headerValue)
 	}
 
 	contentLength := 0
@@ -82,6 +87,7 @@ func (r *Reader) Read() (*frame.Frame, error) {
 		body := make([]byte, contentLength)
 		for bytesRead := 0; bytesRead < contentLength; {
 			n, err := r.reader.Read(body[bytesRead:contentLength])
+			r.bytesRead += int64(n)
 			if err != nil {
 				return nil, err
 			}
@@ -92,6 +98,7 @@ func (r *Reader) Read() (*frame.Frame, error) {
 		if err != nil {
 			return nil, err
 		}
+		r.bytesRead++
 		// if next byte not null, then we have a problem with frame format
 		if tmp != 0 {
 			return nil, errors.New("Content length in fact more than header value. Invalid frame format")
@@ -101,6 +108,7 @@ func (r *Reader) Read() (*frame.Frame, error) {
 
 	} else {
 		body, err := r.reader.ReadBytes(nullByte)
+		r.bytesRead += int64(len(body))
 		if err != nil {
 			return nil, err
 		}
@@ -114,6 +122,7 @@ func (r *Reader) Read() (*frame.Frame, error) {
 //readLine read a line from input and strip LF or CR-LF
 func (r *Reader) readLine() (line []byte, err error) {
 	line, err = r.reader.ReadBytes(newline)
+	r.bytesRead += int64(len(line))
 
 	if err != nil {
 		return
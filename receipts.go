@@ -0,0 +1,142 @@
+package gostomp
+
+import (
+	"context"
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"time"
+)
+
+//ErrReceiptTimeout is returned when the broker did not confirm a frame within the receipt timeout
+var ErrReceiptTimeout = errors.New("timeout waiting for receipt")
+
+//ErrConnectionLost is returned to receipt waiters when the connection breaks before the receipt arrives
+var ErrConnectionLost = errors.New("connection lost before receipt")
+
+//ReceiptPool is kept for compatibility, it is not read or written anymore.
+//
+//Deprecated: receipts are tracked per client, use Producer with DELIVERY_SYNC or Subscription.Receipt to wait for them.
+var ReceiptPool = make(map[string]chan *frame.Frame)
+
+//BrokerError is an ERROR frame sent by the Message Broker
+type BrokerError struct {
+	Message string
+	Headers map[string]string
+	Body    []byte
+}
+
+func newBrokerError(frm *frame.Frame) *BrokerError {
+	return &BrokerError{
+		Message: frm.Headers[message.Message_],
+		Headers: frm.Headers,
+		Body:    frm.Body,
+	}
+}
+
+func (e *BrokerError) Error() string {
+	if len(e.Body) > 0 {
+		return "broker error: " + e.Message + ": " + string(e.Body)
+	}
+	return "broker error: " + e.Message
+}
+
+//WithReceiptTimeout limit how long the client waits for RECEIPT frames, zero waits until the connection breaks
+func WithReceiptTimeout(timeout time.Duration) ClientOption {
+	return func(client *Client) {
+		client.receiptTimeout = timeout
+	}
+}
+
+//expectReceipt register a waiter for the receipt id, it must be done before the frame is sent.
+//The reader paused by flow control reads the socket again until the receipt arrives.
+func (client *Client) expectReceipt(id string) chan *frame.Frame {
+	client.receiptsMutex.Lock()
+	if client.receipts == nil {
+		client.receipts = make(map[string]chan *frame.Frame)
+	}
+	waiter := make(chan *frame.Frame, 1)
+	client.receipts[id] = waiter
+	client.receiptsMutex.Unlock()
+
+	client.wakeReader()
+	return waiter
+}
+
+//receiptsPending reports whether somebody waits for a receipt
+func (client *Client) receiptsPending() bool {
+	client.receiptsMutex.Lock()
+	defer client.receiptsMutex.Unlock()
+
+	return len(client.receipts) > 0
+}
+
+func (client *Client) cancelReceipt(id string) {
+	client.receiptsMutex.Lock()
+	defer client.receiptsMutex.Unlock()
+
+	delete(client.receipts, id)
+}
+
+//resolveReceipt hand RECEIPT or ERROR frame to the waiter of its receipt id.
+//It returns false if nobody waits for the frame.
+func (client *Client) resolveReceipt(frm *frame.Frame) bool {
+	id, ok := frm.Headers[message.ReceiptId]
+	if !ok {
+		return false
+	}
+
+	client.receiptsMutex.Lock()
+	waiter, ok := client.receipts[id]
+	delete(client.receipts, id)
+	client.receiptsMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	waiter <- frm
+	return true
+}
+
+//failReceipts wake up all waiters when the connection is broken
+func (client *Client) failReceipts() {
+	client.receiptsMutex.Lock()
+	defer client.receiptsMutex.Unlock()
+
+	for id, waiter := range client.receipts {
+		waiter <- nil
+		delete(client.receipts, id)
+	}
+}
+
+//awaitReceipt wait for the receipt, ERROR frame correlated with the receipt id is returned as *BrokerError
+func (client *Client) awaitReceipt(id string, waiter chan *frame.Frame) error {
+	return client.awaitReceiptContext(context.Background(), id, waiter)
+}
+
+//awaitReceiptContext wait for the receipt like awaitReceipt, but gives up when ctx is done
+func (client *Client) awaitReceiptContext(ctx context.Context, id string, waiter chan *frame.Frame) error {
+	var timeout <-chan time.Time
+	if client.receiptTimeout > 0 {
+		timer := time.NewTimer(client.receiptTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case frm := <-waiter:
+		if frm == nil {
+			return ErrConnectionLost
+		}
+		if frm.Command == frame.ERROR {
+			return newBrokerError(frm)
+		}
+		return nil
+	case <-timeout:
+		client.cancelReceipt(id)
+		return ErrReceiptTimeout
+	case <-ctx.Done():
+		client.cancelReceipt(id)
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,115 @@
+package gostomp
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultReconnectInterval    = time.Second
+	DefaultMaxReconnectInterval = time.Minute
+)
+
+//ErrReconnectFailed is reported to OnError when all reconnect attempts failed
+var ErrReconnectFailed = errors.New("cannot restore connection")
+
+//ReconnectPolicy describes how a lost connection is restored
+type ReconnectPolicy struct {
+	//MaxAttempts limits the number of attempts, 0 tries until Disconnect or Shutdown is called
+	MaxAttempts int
+	//InitialInterval is the delay before the first attempt, DefaultReconnectInterval if zero
+	InitialInterval time.Duration
+	//MaxInterval caps the delay which doubles after every failed attempt, DefaultMaxReconnectInterval if zero
+	MaxInterval time.Duration
+}
+
+//WithReconnect restore a lost connection and all its subscriptions according to policy.
+//Without it the client goes to StateClosed when the connection is lost.
+func WithReconnect(policy ReconnectPolicy) ClientOption {
+	return func(client *Client) {
+		if policy.InitialInterval <= 0 {
+			policy.InitialInterval = DefaultReconnectInterval
+		}
+		if policy.MaxInterval <= 0 {
+			policy.MaxInterval = DefaultMaxReconnectInterval
+		}
+		client.reconnect = &policy
+	}
+}
+
+//connectionLost is called by the reader when the connection breaks unexpectedly
+func (client *Client) connectionLost(err error) {
+	client.closeConn()
+	client.emitDisconnected(err)
+
+	if client.reconnect == nil {
+		client.setState(StateClosed)
+		return
+	}
+	client.setState(StateReconnecting)
+	go client.reconnectLoop()
+}
+
+//reconnectLoop connect again with exponential backoff and restore subscriptions.
+//It gives up when Disconnect or Shutdown changes the state.
+func (client *Client) reconnectLoop() {
+	policy := client.reconnect
+	interval := policy.InitialInterval
+
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		time.Sleep(interval)
+		if client.State() != StateReconnecting {
+			return
+		}
+
+		err := client.connect(StateReconnecting)
+		if client.State() != StateReconnecting && err != nil {
+			//Disconnect or Shutdown was called meanwhile
+			return
+		}
+		if err == nil {
+			client.logger.Info("connection restored", slog.Int("attempt", attempt))
+			client.resubscribe()
+			client.emitReconnect(attempt)
+			client.emitConnected()
+			return
+		}
+
+		client.logger.Warn("reconnect failed", slog.Int("attempt", attempt), slog.Duration("retry-in", interval), slog.Any("error", err))
+		interval *= 2
+		if interval > policy.MaxInterval {
+			interval = policy.MaxInterval
+		}
+	}
+
+	client.logger.Error("giving up reconnecting", slog.Int("attempts", policy.MaxAttempts))
+	client.reportError(ErrReconnectFailed)
+	client.changeState(StateReconnecting, StateClosed)
+}
+
+//resubscribe send SUBSCRIBE for all registered subscriptions over the new connection.
+//Ack ids of the lost connection are not valid anymore, the broker redelivers unacknowledged messages.
+func (client *Client) resubscribe() {
+	for _, subscription := range client.subscriptionsSnapshot() {
+		if subscription.window != nil {
+			subscription.window.mutex.Lock()
+			subscription.window.detached = false
+			subscription.window.mutex.Unlock()
+		}
+		if subscription.tracker != nil {
+			removed := subscription.tracker.reset()
+			settle(removed, false)
+			client.releaseWindow(subscription, len(removed))
+		}
+
+		frm, err := client.subscribeFrame(subscription)
+		if err == nil {
+			err = client.sender(frm)
+		}
+		if err != nil {
+			client.logger.Error("cannot restore subscription", append(subscriptionAttrs(subscription), slog.Any("error", err))...)
+			client.reportError(err)
+		}
+	}
+}
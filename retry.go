@@ -0,0 +1,149 @@
+package gostomp
+
+import (
+	"context"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryMultiplier     = 2
+	DefaultRetryJitter         = 0.2
+)
+
+//RetryPolicy describes how Client.Producer retries failed sends.
+//If the dialect supports FeatureDuplicateDetection (Artemis), the message-id is set as the duplicate id,
+//so the broker drops copies repeated by retries. Other brokers may receive a message more than once.
+type RetryPolicy struct {
+	//MaxAttempts is the total number of attempts including the first one, 1 or less disables retries
+	MaxAttempts int
+	//InitialBackoff is the delay before the second attempt, DefaultRetryInitialBackoff if zero
+	InitialBackoff time.Duration
+	//MaxBackoff caps the delay, DefaultRetryMaxBackoff if zero
+	MaxBackoff time.Duration
+	//Multiplier grows the delay after every attempt, DefaultRetryMultiplier if zero
+	Multiplier float64
+	//Jitter randomizes every delay by up to this fraction in both directions, DefaultRetryJitter if zero, negative disables it
+	Jitter float64
+	//Retryable decides whether an error is worth another attempt, IsRetryable if nil
+	Retryable func(err error) bool
+}
+
+//WithRetry retry sends of Client.Producer according to policy.
+//While the client is reconnecting, attempts wait for the connection instead of failing immediately.
+//Without WithReconnect sends are not retried once the connection is closed.
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(client *Client) {
+		if policy.InitialBackoff <= 0 {
+			policy.InitialBackoff = DefaultRetryInitialBackoff
+		}
+		if policy.MaxBackoff <= 0 {
+			policy.MaxBackoff = DefaultRetryMaxBackoff
+		}
+		if policy.Multiplier <= 0 {
+			policy.Multiplier = DefaultRetryMultiplier
+		}
+		if policy.Jitter == 0 {
+			policy.Jitter = DefaultRetryJitter
+		}
+		if policy.Retryable == nil {
+			policy.Retryable = IsRetryable
+		}
+		client.retry = &policy
+	}
+}
+
+//IsRetryable reports whether a send error is transient.
+//Network errors, a lost connection and a missing receipt are retryable.
+//ERROR frames of the broker, unsupported features and sends after Disconnect are not,
+//the same message would be rejected again.
+func IsRetryable(err error) bool {
+	var brokerErr *BrokerError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &brokerErr),
+		errors.Is(err, ErrUnsupportedFeature),
+		errors.Is(err, ErrDisconnecting):
+		return false
+	case errors.Is(err, ErrConnectionLost),
+		errors.Is(err, ErrReceiptTimeout),
+		errors.Is(err, ErrNotConnected),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+//sendWithRetry call send until it succeeds, fails with a permanent error, attempts run out or ctx is done
+func (client *Client) sendWithRetry(ctx context.Context, send SendFunc, msg *message.Message, deliveryMode bool) error {
+	policy := client.retry
+	if policy == nil || policy.MaxAttempts <= 1 {
+		return send(msg, deliveryMode)
+	}
+
+	if client.dialect.Supports(FeatureDuplicateDetection) {
+		err := client.dialect.SetDuplicateId(msg, msg.GetID())
+		if err != nil {
+			return err
+		}
+	}
+
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := send(msg, deliveryMode)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.Retryable(err) {
+			return err
+		}
+		if client.State() == StateClosed && client.reconnect == nil {
+			//nothing restores the connection
+			return err
+		}
+
+		delay := policy.jitter(backoff)
+		client.logger.Warn("send failed, retrying",
+			slog.String("message-id", msg.GetID()),
+			slog.Int("attempt", attempt),
+			slog.Duration("retry-in", delay),
+			slog.Any("error", err),
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		//a lost connection is being restored, the next attempt would fail the same way
+		if state := client.State(); state == StateReconnecting || state == StateConnecting {
+			client.awaitConnected(policy.MaxBackoff)
+		}
+
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+func (policy *RetryPolicy) jitter(backoff time.Duration) time.Duration {
+	if policy.Jitter <= 0 {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + policy.Jitter*(2*rand.Float64()-1)))
+}
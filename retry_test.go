@@ -0,0 +1,67 @@
+package gostomp
+
+import (
+	"context"
+	"errors"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRetryStopsWhenClosedWithoutReconnect(t *testing.T) {
+	attempts := 0
+	client, err := NewClient("tcp://localhost:61613",
+		WithRetry(RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}),
+		WithSendMiddleware(func(next SendFunc) SendFunc {
+			return func(msg *message.Message, deliveryMode bool) error {
+				attempts++
+				return next(msg, deliveryMode)
+			}
+		}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Producer(message.New([]byte("order")), DELIVERY_SYNC)
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("closed client is retried, %d attempts", attempts)
+	}
+}
+
+func TestRetryKeepsDuplicateId(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613?dialect=artemis",
+		WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: -1}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.setState(StateConnected)
+
+	ids := make([]string, 0)
+	send := func(msg *message.Message, deliveryMode bool) error {
+		ids = append(ids, msg.GetHeaders()["_AMQ_DUPL_ID"])
+		if len(ids) < 3 {
+			return ErrReceiptTimeout
+		}
+		return nil
+	}
+	msg := message.New([]byte("order"))
+	msg.SetID("m1")
+	err = client.sendWithRetry(context.Background(), send, msg, DELIVERY_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if id != "m1" {
+			t.Fatalf("unexpected duplicate ids %v", ids)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package gostomp
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//Schedule describes delayed and repeated delivery of a message
+type Schedule struct {
+	//Delay before the first delivery
+	Delay time.Duration
+	//Period between repeated deliveries
+	Period time.Duration
+	//Repeat is the number of deliveries after the first one, it requires Period
+	Repeat int
+	//Cron expression of delivery times, supported by the broker only (ActiveMQ)
+	Cron string
+}
+
+func (schedule Schedule) validate() error {
+	if schedule.Delay < 0 || schedule.Period < 0 || schedule.Repeat < 0 {
+		return errors.New("schedule delay, period and repeat must not be negative")
+	}
+	if schedule.Repeat > 0 && schedule.Period == 0 {
+		return errors.New("repeated schedule requires period")
+	}
+	return nil
+}
+
+//WithClientScheduler hold scheduled messages in memory and send them when due,
+//if the broker dialect does not support FeatureDelay or FeatureRecurring.
+//The scheduler runs from Connect until the client is closed, messages which became due meanwhile are sent
+//after the next Connect. Messages which are not due yet are lost when the process stops.
+func WithClientScheduler() ClientOption {
+	return func(client *Client) {
+		if client.scheduler != nil {
+			return
+		}
+		client.scheduler = &scheduler{
+			client: client,
+			wakeup: make(chan struct{}, 1),
+		}
+	}
+}
+
+//Schedule send the message to be delivered at the time.
+//The broker holds the message if the dialect supports it, otherwise the client scheduler does, see WithClientScheduler.
+func (client *Client) Schedule(msg *message.Message, at time.Time, deliveryMode bool) error {
+	if client.dialect.Supports(FeatureDelay) || client.scheduler == nil {
+		err := client.dialect.SetDeliveryTime(msg, at)
+		if err != nil {
+			return err
+		}
+		return client.Producer(msg, deliveryMode)
+	}
+
+	client.scheduler.add(&scheduledMessage{msg: msg, at: at, deliveryMode: deliveryMode})
+	return nil
+}
+
+//ScheduleAfter send the message to be delivered after the delay, see Schedule
+func (client *Client) ScheduleAfter(msg *message.Message, delay time.Duration, deliveryMode bool) error {
+	return client.Schedule(msg, time.Now().Add(delay), deliveryMode)
+}
+
+//ScheduleRecurring send the message to be delivered according to schedule.
+//The client scheduler does not support Cron, every copy it sends gets a new message-id.
+func (client *Client) ScheduleRecurring(msg *message.Message, schedule Schedule, deliveryMode bool) error {
+	if client.dialect.Supports(FeatureRecurring) || client.scheduler == nil {
+		err := client.dialect.SetSchedule(msg, schedule)
+		if err != nil {
+			return err
+		}
+		return client.Producer(msg, deliveryMode)
+	}
+
+	err := schedule.validate()
+	if err != nil {
+		return err
+	}
+	if schedule.Cron != "" {
+		return &UnsupportedFeatureError{Dialect: "client scheduler", Feature: FeatureRecurring}
+	}
+
+	client.scheduler.add(&scheduledMessage{
+		msg:          msg,
+		at:           time.Now().Add(schedule.Delay),
+		period:       schedule.Period,
+		repeat:       schedule.Repeat,
+		deliveryMode: deliveryMode,
+	})
+	return nil
+}
+
+//ScheduledPending returns the number of messages held by the client scheduler
+func (client *Client) ScheduledPending() int {
+	if client.scheduler == nil {
+		return 0
+	}
+
+	client.scheduler.mutex.Lock()
+	defer client.scheduler.mutex.Unlock()
+	return len(client.scheduler.queue)
+}
+
+type scheduler struct {
+	client *Client
+	mutex  sync.Mutex
+	queue  scheduleQueue
+	//seq keeps the order of messages scheduled for the same time
+	seq    uint64
+	wakeup chan struct{}
+}
+
+type scheduledMessage struct {
+	msg          *message.Message
+	at           time.Time
+	period       time.Duration
+	repeat       int
+	deliveryMode bool
+	seq          uint64
+}
+
+func (scheduler *scheduler) add(scheduled *scheduledMessage) {
+	scheduler.mutex.Lock()
+	scheduler.seq++
+	scheduled.seq = scheduler.seq
+	heap.Push(&scheduler.queue, scheduled)
+	scheduler.mutex.Unlock()
+
+	select {
+	case scheduler.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+//run send messages when they are due until stop is closed.
+//Every message is sent in its own goroutine, so a send waiting for its receipt does not delay the others.
+func (scheduler *scheduler) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		scheduler.mutex.Lock()
+		var next *scheduledMessage
+		if len(scheduler.queue) > 0 {
+			next = scheduler.queue[0]
+		}
+		if next != nil && !next.at.After(time.Now()) {
+			heap.Pop(&scheduler.queue)
+			scheduler.mutex.Unlock()
+			go scheduler.send(next)
+			continue
+		}
+		scheduler.mutex.Unlock()
+
+		if next == nil {
+			select {
+			case <-scheduler.wakeup:
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		//wakeup means an earlier message may have been added
+		timer := time.NewTimer(time.Until(next.at))
+		select {
+		case <-scheduler.wakeup:
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (scheduler *scheduler) send(scheduled *scheduledMessage) {
+	msg := scheduled.msg
+	if scheduled.repeat > 0 {
+		//the original is kept for the next delivery, every copy is a new message
+		msg = msg.Clone()
+		msg.SetID(uuid.New().String())
+
+		scheduler.add(&scheduledMessage{
+			msg:          scheduled.msg,
+			at:           scheduled.at.Add(scheduled.period),
+			period:       scheduled.period,
+			repeat:       scheduled.repeat - 1,
+			deliveryMode: scheduled.deliveryMode,
+		})
+	}
+
+	err := scheduler.client.Producer(msg, scheduled.deliveryMode)
+	if err != nil {
+		scheduler.client.logger.Error("cannot send scheduled message", slog.String("message-id", msg.GetID()), slog.Any("error", err))
+		scheduler.client.reportError(err)
+	}
+}
+
+//scheduleQueue is a heap of messages ordered by delivery time
+type scheduleQueue []*scheduledMessage
+
+func (queue scheduleQueue) Len() int {
+	return len(queue)
+}
+
+func (queue scheduleQueue) Less(i, j int) bool {
+	if queue[i].at.Equal(queue[j].at) {
+		return queue[i].seq < queue[j].seq
+	}
+	return queue[i].at.Before(queue[j].at)
+}
+
+func (queue scheduleQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+}
+
+func (queue *scheduleQueue) Push(x any) {
+	*queue = append(*queue, x.(*scheduledMessage))
+}
+
+func (queue *scheduleQueue) Pop() any {
+	old := *queue
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return last
+}
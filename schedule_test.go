@@ -0,0 +1,91 @@
+package gostomp
+
+import (
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSchedulerClient(t *testing.T, conn *recordingConn) *Client {
+	t.Helper()
+
+	client, err := NewClient("tcp://localhost:61613", WithClientScheduler(), WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.startBackground()
+	client.setConn(conn)
+	client.setState(StateConnected)
+	return client
+}
+
+func sentCount(conn *recordingConn) int {
+	count := 0
+	for _, frm := range conn.frames() {
+		if strings.HasPrefix(frm, "SEND ") {
+			count++
+		}
+	}
+	return count
+}
+
+func awaitSent(t *testing.T, conn *recordingConn, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sentCount(conn) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d sent messages, got %d", count, sentCount(conn))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newScheduledMessage(id string) *message.Message {
+	msg := message.New([]byte("report"))
+	msg.SetID(id)
+	msg.SetDestination("/queue/reports")
+	return msg
+}
+
+func TestSchedulerDoesNotWaitForReceipts(t *testing.T) {
+	conn := &recordingConn{}
+	client := newSchedulerClient(t, conn)
+	defer func() {
+		client.failReceipts()
+		client.closed(nil)
+	}()
+
+	//the receipt of m1 never arrives
+	err := client.ScheduleAfter(newScheduledMessage("m1"), 0, DELIVERY_SYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.ScheduleAfter(newScheduledMessage("m2"), 10*time.Millisecond, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSent(t, conn, 2)
+}
+
+func TestSchedulerStopsWhenClosed(t *testing.T) {
+	conn := &recordingConn{}
+	client := newSchedulerClient(t, conn)
+
+	client.closed(nil)
+	err := client.ScheduleAfter(newScheduledMessage("m1"), 0, DELIVERY_ASYNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if pending := client.ScheduledPending(); pending != 1 {
+		t.Fatalf("closed scheduler took the message, %d pending", pending)
+	}
+
+	client.startBackground()
+	client.setState(StateConnected)
+	awaitSent(t, conn, 1)
+}
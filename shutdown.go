@@ -0,0 +1,132 @@
+package gostomp
+
+import (
+	"context"
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"log/slog"
+	"sync"
+)
+
+//Shutdown stop the client gracefully:
+//wait until running callbacks of client ack modes return and send their batched ACKs,
+//unsubscribe all subscriptions, wait until the remaining callbacks return,
+//send DISCONNECT, wait for its receipt and close the socket.
+//
+//ACKs are sent before UNSUBSCRIBE because brokers like ActiveMQ drop ACKs of an unsubscribed consumer.
+//Messages of client ack modes arriving meanwhile are not handled and redelivered by the broker,
+//messages of auto ack mode are handled until the broker confirms UNSUBSCRIBE.
+//
+//If ctx is done first, the socket is closed immediately and the error of ctx is returned.
+//Messages which were not acknowledged are redelivered by the broker.
+//ErrNotConnected is returned if the client is not connected.
+func (client *Client) Shutdown(ctx context.Context) error {
+	if client.State() == StateClosed {
+		return ErrNotConnected
+	}
+	client.draining.Store(true)
+	err := client.drain(ctx)
+	if err != nil {
+		client.logger.Error("graceful shutdown failed", slog.Any("error", err))
+		client.setState(StateDisconnecting)
+		client.failReceipts()
+		client.closed(err)
+		return err
+	}
+
+	//disconnect closes the socket and removes the subscriptions
+	return client.disconnect(ctx)
+}
+
+//drain wait for callbacks and ACKs and unsubscribe, subscriptions stay registered
+//so messages of auto ack mode which are already on the way are still handled
+func (client *Client) drain(ctx context.Context) error {
+	subscriptions := client.subscriptionsSnapshot()
+
+	//Wait must not run concurrently with Add of a new callback
+	client.handlersMutex.Lock()
+	client.ackHandlersStopped = true
+	client.handlersMutex.Unlock()
+	err := awaitGroup(ctx, &client.ackHandlers)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		err := client.FlushAcks(subscription)
+		if err != nil {
+			return err
+		}
+	}
+
+	waiters := make(map[string]chan *frame.Frame)
+	for _, subscription := range subscriptions {
+		if subscription.detached() {
+			//the broker does not know the subscription, flow control does not subscribe it again while draining
+			continue
+		}
+
+		frm := frame.NewFrame(frame.UNSUBSCRIBE, []byte(""))
+		frm.Headers[message.Id] = subscription.GetID()
+		receiptId := "unsubscribe-" + subscription.GetID()
+		frm.Headers[message.Receipt] = receiptId
+		waiter := client.expectReceipt(receiptId)
+
+		err := client.sender(frm)
+		if err != nil {
+			client.cancelReceipt(receiptId)
+			return errors.New("Cannot unsubscribe " + subscription.GetID() + ". Reason: " + err.Error())
+		}
+		waiters[receiptId] = waiter
+	}
+
+	//MESSAGE frames are read in order, so no delivery for the subscription follows its receipt
+	for receiptId, waiter := range waiters {
+		err := client.awaitReceiptContext(ctx, receiptId, waiter)
+		var brokerErr *BrokerError
+		if errors.As(err, &brokerErr) {
+			client.logger.Warn("broker rejected UNSUBSCRIBE on shutdown", slog.String("receipt", receiptId), slog.Any("error", err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	//deliveries read before the receipts may still wait in the inbox
+	if inbox := client.inbox.Load(); inbox != nil {
+		err := inbox.awaitIdle(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	client.handlersMutex.Lock()
+	client.handlersStopped = true
+	client.handlersMutex.Unlock()
+	return awaitGroup(ctx, &client.handlers)
+}
+
+//awaitGroup wait for group until ctx is done
+func awaitGroup(ctx context.Context, group *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (client *Client) subscriptionsSnapshot() []*Subscription {
+	client.subscriptionsMutex.RLock()
+	defer client.subscriptionsMutex.RUnlock()
+
+	subscriptions := make([]*Subscription, len(client.subscriptions))
+	copy(subscriptions, client.subscriptions)
+	return subscriptions
+}
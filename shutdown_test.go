@@ -0,0 +1,170 @@
+package gostomp
+
+import (
+	"context"
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownNotConnected(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Shutdown(context.Background())
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	err = client.Disconnect()
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestShutdownSkipsDetachedSubscription(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		MaxInFlight: 1,
+		FlowControl: FLOW_RESUBSCRIBE,
+		Callback: func(msg *message.Message) {
+			close(started)
+			<-finish
+		},
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	broker.deliver(subscription, "m1")
+	<-started
+	if headers := broker.expect(frame.UNSUBSCRIBE); headers[message.Receipt] != "" {
+		t.Fatal("flow control detached the subscription with a receipt")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+	receiptId := ""
+	for raw := range broker.frames {
+		lines := strings.Split(raw, "\n")
+		if lines[0] == frame.UNSUBSCRIBE || lines[0] == frame.SUBSCRIBE {
+			t.Fatalf("unexpected %s of a detached subscription on shutdown", lines[0])
+		}
+		if lines[0] == frame.DISCONNECT {
+			for _, line := range lines[1:] {
+				if strings.HasPrefix(line, message.Receipt+":") {
+					receiptId = strings.TrimPrefix(line, message.Receipt+":")
+				}
+			}
+			break
+		}
+	}
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: receiptId})
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown does not return")
+	}
+}
+
+func TestShutdownFlushesAcksBeforeUnsubscribe(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	subscription := &Subscription{
+		Destination:  "/queue/orders",
+		Ack:          ACK_CLIENT,
+		AckBatchSize: 10,
+	}
+	subscription.Callback = func(msg *message.Message) {
+		if msg.GetID() != "m1" {
+			t.Errorf("callback is started for %s while Shutdown waits", msg.GetID())
+			return
+		}
+		close(started)
+		<-finish
+		client.Ack(msg)
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	broker.deliver(subscription, "m1")
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	broker.deliver(subscription, "m2")
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+
+	headers := broker.expect(frame.ACK)
+	if headers[message.Id] != "ack-m1" {
+		t.Fatalf("unexpected ACK of %s", headers[message.Id])
+	}
+	headers = broker.expect(frame.UNSUBSCRIBE)
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+	headers = broker.expect(frame.DISCONNECT)
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown does not return")
+	}
+}
+
+func TestAwaitIdleReturnsWhenContextIsDone(t *testing.T) {
+	inbox := newInbox()
+	defer inbox.close()
+	inbox.push(frame.NewFrame(frame.MESSAGE, []byte("")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := inbox.awaitIdle(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	//nothing waits on the inbox anymore, delivery takes the frame as usual
+	if _, ok := inbox.next(); !ok {
+		t.Fatal("frame is lost")
+	}
+	go inbox.next()
+	err = inbox.awaitIdle(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,452 @@
+package gostomp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/msidorenko/gostomp/message"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultSpoolRetryInterval is the delay before a spooled message is sent again after a failure
+	DefaultSpoolRetryInterval = 5 * time.Second
+	//DefaultSpoolSendTimeout limits the wait for the receipt of a spooled message
+	DefaultSpoolSendTimeout = 30 * time.Second
+)
+
+const (
+	spoolDataFile   = "spool.log"
+	spoolOffsetFile = "spool.offset"
+	//spoolRecordHeader is the length and the CRC-32 of the payload
+	spoolRecordHeader = 8
+	//spoolCompactSize is the size of confirmed records from which the spool is compacted
+	//when they take more than half of the file
+	spoolCompactSize = 1 << 20
+)
+
+var errSpoolTornRecord = errors.New("incomplete spool record")
+
+//SpoolConfig describes the local spool of SpoolingProducer
+type SpoolConfig struct {
+	//Dir holds the spool files, it is created if missing
+	Dir string
+	//Sync calls fsync after every spooled message and confirmation, otherwise a crash of the OS may lose them
+	Sync bool
+	//RetryInterval is the delay before sending again after a failure, DefaultSpoolRetryInterval if zero
+	RetryInterval time.Duration
+	//SendTimeout limits the wait for the receipt of a message, it is sent again afterwards.
+	//DefaultSpoolSendTimeout if zero.
+	SendTimeout time.Duration
+	//OnRejected is called when the broker answers a message with ERROR, the message is removed from the spool.
+	//Without it rejected messages are logged and dropped.
+	OnRejected func(msg *message.Message, err error)
+}
+
+//SpoolingProducer writes messages to a local append-only spool and sends them in order in the background.
+//A message is removed from the spool only after the broker confirmed it with RECEIPT,
+//so messages survive broker outages and restarts of the process. A message may be sent twice
+//if the process stops between the receipt and the confirmation, its message-id stays the same.
+type SpoolingProducer struct {
+	client *Client
+	config SpoolConfig
+	mutex  sync.Mutex
+	data   *os.File
+	//size is the end of the last complete record
+	size int64
+	//offset is the start of the first record which is not confirmed yet
+	offset  int64
+	pending int
+	wakeup  chan struct{}
+	//ctx is canceled by Close, it interrupts the message being sent
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type spoolRecord struct {
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+//NewSpoolingProducer open the spool in config.Dir and start sending messages which are left in it
+func NewSpoolingProducer(client *Client, config SpoolConfig) (*SpoolingProducer, error) {
+	if config.Dir == "" {
+		return nil, errors.New("spool directory is not set")
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultSpoolRetryInterval
+	}
+	if config.SendTimeout <= 0 {
+		config.SendTimeout = DefaultSpoolSendTimeout
+	}
+
+	err := os.MkdirAll(config.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(config.Dir, spoolDataFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	producer := &SpoolingProducer{
+		client: client,
+		config: config,
+		data:   data,
+		wakeup: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	err = producer.recover()
+	if err != nil {
+		data.Close()
+		return nil, errors.New("Cannot open spool. Reason: " + err.Error())
+	}
+	producer.ctx, producer.cancel = context.WithCancel(context.Background())
+
+	go producer.drainLoop()
+	return producer, nil
+}
+
+//Producer append the message to the spool, it returns when the message is persisted locally
+func (producer *SpoolingProducer) Producer(msg *message.Message) error {
+	if msg.GetID() == "" {
+		msg.SetID(uuid.New().String())
+	}
+
+	payload, err := json.Marshal(spoolRecord{Headers: msg.GetHeaders(), Body: msg.GetBody()})
+	if err != nil {
+		return err
+	}
+	record := make([]byte, spoolRecordHeader+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolRecordHeader:], payload)
+
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+
+	if producer.ctx.Err() != nil {
+		return errors.New("spooling producer is closed")
+	}
+
+	_, err = producer.data.WriteAt(record, producer.size)
+	if err != nil {
+		return errors.New("Cannot write message to spool. Reason: " + err.Error())
+	}
+	if producer.config.Sync {
+		err = producer.data.Sync()
+		if err != nil {
+			return errors.New("Cannot sync spool. Reason: " + err.Error())
+		}
+	}
+	producer.size += int64(len(record))
+	producer.pending++
+
+	select {
+	case producer.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Pending returns the number of spooled messages not confirmed by the broker yet
+func (producer *SpoolingProducer) Pending() int {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+
+	return producer.pending
+}
+
+//Close stop sending, messages left in the spool are sent by the next SpoolingProducer with the same Dir.
+//The message being sent is not waited for, it is sent again as well.
+func (producer *SpoolingProducer) Close() error {
+	producer.cancel()
+	<-producer.done
+
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+	return producer.data.Close()
+}
+
+//recover read the confirmed offset and count pending records, a torn record at the end is cut off
+func (producer *SpoolingProducer) recover() error {
+	content, err := os.ReadFile(filepath.Join(producer.config.Dir, spoolOffsetFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		producer.offset, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return errors.New("invalid spool offset")
+		}
+	}
+
+	info, err := producer.data.Stat()
+	if err != nil {
+		return err
+	}
+	if producer.offset > info.Size() {
+		//the offset file does not belong to the spool, everything in it is sent again
+		producer.client.logger.Warn("spool offset is beyond the end of the spool", slog.Int64("offset", producer.offset))
+		producer.offset = 0
+	}
+
+	end := producer.offset
+	for {
+		_, next, err := producer.readRecord(end, info.Size())
+		if err == io.EOF {
+			break
+		}
+		if err == errSpoolTornRecord {
+			producer.client.logger.Warn("incomplete spool record is dropped", slog.Int64("offset", end))
+			break
+		}
+		if err != nil {
+			return err
+		}
+		end = next
+		producer.pending++
+	}
+
+	producer.size = end
+	if end < info.Size() {
+		return producer.data.Truncate(end)
+	}
+	return nil
+}
+
+//readRecord returns the payload of the record at offset and the offset of the next record.
+//A record reaching beyond end is incomplete, its length is not trusted.
+func (producer *SpoolingProducer) readRecord(offset, end int64) ([]byte, int64, error) {
+	header := make([]byte, spoolRecordHeader)
+	n, err := producer.data.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if n < spoolRecordHeader {
+		return nil, 0, errSpoolTornRecord
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > end-offset-spoolRecordHeader {
+		return nil, 0, errSpoolTornRecord
+	}
+	payload := make([]byte, length)
+	n, err = producer.data.ReadAt(payload, offset+spoolRecordHeader)
+	if n < len(payload) {
+		if err == io.EOF {
+			return nil, 0, errSpoolTornRecord
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolTornRecord
+	}
+	return payload, offset + spoolRecordHeader + int64(len(payload)), nil
+}
+
+//drainLoop send spooled messages one by one, each waits for its receipt
+func (producer *SpoolingProducer) drainLoop() {
+	defer close(producer.done)
+
+	for {
+		if producer.ctx.Err() != nil {
+			return
+		}
+
+		producer.mutex.Lock()
+		offset, size := producer.offset, producer.size
+		producer.mutex.Unlock()
+
+		if offset == size {
+			select {
+			case <-producer.ctx.Done():
+				return
+			case <-producer.wakeup:
+			}
+			continue
+		}
+
+		payload, next, err := producer.readRecord(offset, size)
+		if err != nil {
+			producer.client.logger.Error("cannot read spool", slog.Int64("offset", offset), slog.Any("error", err))
+			if !producer.sleep() {
+				return
+			}
+			continue
+		}
+
+		var record spoolRecord
+		err = json.Unmarshal(payload, &record)
+		if err != nil {
+			//a record with valid checksum but broken content cannot be fixed by retrying
+			producer.client.logger.Error("dropping invalid spool record", slog.Int64("offset", offset), slog.Any("error", err))
+			producer.confirm(next)
+			continue
+		}
+		msg := message.New(record.Body)
+		for key, value := range record.Headers {
+			msg.SetHeader(key, value)
+		}
+
+		if producer.client.State() != StateConnected {
+			if !producer.sleep() {
+				return
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(producer.ctx, producer.config.SendTimeout)
+		err = producer.client.produce(ctx, msg, DELIVERY_SYNC)
+		cancel()
+		var brokerErr *BrokerError
+		if errors.As(err, &brokerErr) {
+			producer.client.logger.Error("broker rejected spooled message", slog.String("message-id", msg.GetID()), slog.Any("error", err))
+			if producer.config.OnRejected != nil {
+				producer.config.OnRejected(msg, err)
+			}
+		} else if err != nil {
+			producer.client.logger.Warn("cannot send spooled message", slog.String("message-id", msg.GetID()), slog.Any("error", err))
+			if !producer.sleep() {
+				return
+			}
+			continue
+		}
+
+		err = producer.confirm(next)
+		if err != nil {
+			producer.client.logger.Error("cannot update spool offset", slog.Any("error", err))
+		}
+	}
+}
+
+//sleep wait for the retry interval, it returns false when the producer is closed
+func (producer *SpoolingProducer) sleep() bool {
+	timer := time.NewTimer(producer.config.RetryInterval)
+	defer timer.Stop()
+
+	select {
+	case <-producer.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+//confirm move the offset past the sent record, empty the spool when everything is sent
+//and compact it when confirmed records take most of it.
+//The offset file never points past records which are not confirmed: offset 0 is written before
+//the spool is emptied or replaced, so a failure in between only sends confirmed records again.
+func (producer *SpoolingProducer) confirm(next int64) error {
+	producer.mutex.Lock()
+	defer producer.mutex.Unlock()
+
+	producer.offset = next
+	producer.pending--
+	if producer.offset == producer.size {
+		err := producer.writeOffset(0)
+		if err != nil {
+			return err
+		}
+		err = producer.data.Truncate(0)
+		if err != nil {
+			return err
+		}
+		producer.offset, producer.size = 0, 0
+		return nil
+	}
+	if producer.offset >= spoolCompactSize && producer.offset > producer.size-producer.offset {
+		err := producer.compact()
+		if err == nil {
+			return nil
+		}
+		producer.client.logger.Error("cannot compact spool", slog.Any("error", err))
+	}
+	return producer.writeOffset(producer.offset)
+}
+
+//compact rewrite the spool without confirmed records, the new file replaces the old one atomically.
+//Offset 0 is written before the rename, if the process stops in between
+//the confirmed records of the old file are sent again.
+func (producer *SpoolingProducer) compact() error {
+	path := filepath.Join(producer.config.Dir, spoolDataFile)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, io.NewSectionReader(producer.data, producer.offset, producer.size-producer.offset))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = producer.writeOffset(0)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	producer.data.Close()
+	producer.data = file
+	producer.size -= producer.offset
+	producer.offset = 0
+	return syncDir(producer.config.Dir)
+}
+
+//writeOffset replace the offset file atomically
+func (producer *SpoolingProducer) writeOffset(offset int64) error {
+	path := filepath.Join(producer.config.Dir, spoolOffsetFile)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.FormatInt(offset, 10))
+	if err == nil && producer.config.Sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err == nil && producer.config.Sync {
+		err = syncDir(producer.config.Dir)
+	}
+	return err
+}
+
+//syncDir fsync the directory, so a renamed file survives a crash of the OS
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,328 @@
+package gostomp
+
+import (
+	"encoding/json"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//openSpool returns a producer of a client which is not connected, so nothing is sent
+func openSpool(t *testing.T, dir string) *SpoolingProducer {
+	t.Helper()
+
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer, err := NewSpoolingProducer(client, SpoolConfig{Dir: dir, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return producer
+}
+
+func spoolMessages(t *testing.T, producer *SpoolingProducer, count int, body []byte) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		msg := message.New(body)
+		msg.SetID("m" + strconv.Itoa(i))
+		msg.SetDestination("/queue/orders")
+		err := producer.Producer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//firstPending returns the message-id of the first record which is not confirmed and the offset of the next one
+func firstPending(t *testing.T, producer *SpoolingProducer) (string, int64) {
+	t.Helper()
+
+	producer.mutex.Lock()
+	offset, size := producer.offset, producer.size
+	producer.mutex.Unlock()
+
+	payload, next, err := producer.readRecord(offset, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record spoolRecord
+	err = json.Unmarshal(payload, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record.Headers[message.MessageId], next
+}
+
+func closeSpool(t *testing.T, producer *SpoolingProducer) {
+	t.Helper()
+
+	err := producer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolRecoversFromTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 3, []byte("order"))
+	closeSpool(t, producer)
+
+	path := filepath.Join(dir, spoolDataFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the process stopped in the middle of writing a record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{', '"'})
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer = openSpool(t, dir)
+	if pending := producer.Pending(); pending != 3 {
+		t.Fatalf("expected 3 pending messages, got %d", pending)
+	}
+	torn, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torn.Size() != info.Size() {
+		t.Fatalf("torn record is not cut off, size %d instead of %d", torn.Size(), info.Size())
+	}
+
+	spoolMessages(t, producer, 1, []byte("order"))
+	closeSpool(t, producer)
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 4 {
+		t.Fatalf("message spooled after recovery is lost, %d pending", pending)
+	}
+}
+
+func TestSpoolRestartAfterPartialConfirm(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 3, []byte("order"))
+
+	_, next := firstPending(t, producer)
+	err := producer.confirm(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeSpool(t, producer)
+
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", pending)
+	}
+	if id, _ := firstPending(t, producer); id != "m1" {
+		t.Fatalf("expected m1 to be sent first after restart, got %s", id)
+	}
+}
+
+func TestSpoolCompaction(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 24, make([]byte, 64*1024))
+
+	path := filepath.Join(dir, spoolDataFile)
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		_, next := firstPending(t, producer)
+		err = producer.confirm(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size()/2 {
+		t.Fatalf("spool is not compacted, size %d of %d", after.Size(), before.Size())
+	}
+	closeSpool(t, producer)
+
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 8 {
+		t.Fatalf("expected 8 pending messages, got %d", pending)
+	}
+	if id, _ := firstPending(t, producer); id != "m16" {
+		t.Fatalf("expected m16 to be sent first after compaction, got %s", id)
+	}
+}
+
+func TestSpoolCloseInterruptsSend(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	producer, err := NewSpoolingProducer(client, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolMessages(t, producer, 1, []byte("order"))
+	//the broker never confirms the message
+	broker.expect(frame.SEND)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- producer.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waits for the receipt")
+	}
+}
+
+//failOffsetWrites make writeOffset fail until the returned function is called
+func failOffsetWrites(t *testing.T, dir string) func() {
+	t.Helper()
+
+	tmp := filepath.Join(dir, spoolOffsetFile+".tmp")
+	err := os.Mkdir(tmp, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		err := os.Remove(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpoolKeepsRecordsWhenOffsetWriteFails(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 2, []byte("order"))
+	_, next := firstPending(t, producer)
+	err := producer.confirm(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the spool must not be emptied while the offset file still points into it
+	restore := failOffsetWrites(t, dir)
+	_, next = firstPending(t, producer)
+	if err := producer.confirm(next); err == nil {
+		t.Fatal("failed offset write is not reported")
+	}
+	restore()
+
+	for i := 0; i < 3; i++ {
+		msg := message.New([]byte("order of the next batch"))
+		msg.SetID("n" + strconv.Itoa(i))
+		msg.SetDestination("/queue/orders")
+		err := producer.Producer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeSpool(t, producer)
+
+	//m1 is sent again because its confirmation was not persisted, the next batch is kept
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 4 {
+		t.Fatalf("expected 4 pending messages, got %d", pending)
+	}
+	if id, _ := firstPending(t, producer); id != "m1" {
+		t.Fatalf("expected m1 to be sent first after restart, got %s", id)
+	}
+}
+
+func TestSpoolCompactionWhenOffsetWriteFails(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 24, make([]byte, 64*1024))
+
+	//confirm records until the next confirmation compacts the spool
+	confirmed := 0
+	for {
+		_, next := firstPending(t, producer)
+		if next >= spoolCompactSize && next > producer.size-next {
+			break
+		}
+		err := producer.confirm(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		confirmed++
+	}
+
+	path := filepath.Join(dir, spoolDataFile)
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := failOffsetWrites(t, dir)
+	_, next := firstPending(t, producer)
+	if err := producer.confirm(next); err == nil {
+		t.Fatal("failed offset write is not reported")
+	}
+	restore()
+	if after, err := os.Stat(path); err != nil || after.Size() != before.Size() {
+		t.Fatalf("spool is replaced although the offset is not written, error %v", err)
+	}
+	spoolMessages(t, producer, 1, []byte("order"))
+	closeSpool(t, producer)
+
+	//the confirmation is not persisted, so the record is sent again
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 24-confirmed+1 {
+		t.Fatalf("expected %d pending messages, got %d", 24-confirmed+1, pending)
+	}
+	if id, _ := firstPending(t, producer); id != "m"+strconv.Itoa(confirmed) {
+		t.Fatalf("expected m%d to be sent first after restart, got %s", confirmed, id)
+	}
+}
+
+func TestSpoolRejectsOversizedRecordLength(t *testing.T) {
+	dir := t.TempDir()
+	producer := openSpool(t, dir)
+	spoolMessages(t, producer, 2, []byte("order"))
+	closeSpool(t, producer)
+
+	//a corrupted length must not make recover allocate up to 4 GB
+	file, err := os.OpenFile(filepath.Join(dir, spoolDataFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, '{', '"'})
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer = openSpool(t, dir)
+	defer closeSpool(t, producer)
+	if pending := producer.Pending(); pending != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", pending)
+	}
+}
@@ -0,0 +1,243 @@
+package gostomp
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+//State of the connection with the Message Broker
+type State int32
+
+const (
+	//StateClosed is the state before Connect and after the connection is closed for good
+	StateClosed State = iota
+	StateConnecting
+	StateConnected
+	//StateReconnecting is the state after the connection was lost while WithReconnect tries to restore it
+	StateReconnecting
+	//StateDisconnecting is the state after DISCONNECT is sent, no other frames are sent then
+	StateDisconnecting
+)
+
+func (state State) String() string {
+	switch state {
+	case StateClosed:
+		return "closed"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateDisconnecting:
+		return "disconnecting"
+	}
+	return "unknown"
+}
+
+//ErrDisconnecting is returned for frames sent after DISCONNECT
+var ErrDisconnecting = errors.New("Disconnect in progress. Clients MUST NOT send any more frames after the DISCONNECT frame is sent.")
+
+//ErrNotConnected is returned for frames sent before Connect or after the connection is closed
+var ErrNotConnected = errors.New("client is not connected")
+
+//DefaultEventBuffer is the number of lifecycle events queued for Hooks before new events are dropped
+const DefaultEventBuffer = 64
+
+//DefaultErrorsBuffer is the capacity of Client.Errors, errors are dropped when nobody reads them
+const DefaultErrorsBuffer = 16
+
+//Hooks are called on lifecycle events of the client, any of them may be nil.
+//They run one by one in a separate goroutine, so a slow hook never blocks reading or writing frames,
+//but events are dropped when more than DefaultEventBuffer of them are waiting.
+//The goroutine starts with Connect and stops when the client is closed, after queued events are handled.
+type Hooks struct {
+	OnConnected func()
+	//OnDisconnected receives the reason the connection was lost, nil after Disconnect or Shutdown
+	OnDisconnected func(err error)
+	//OnError receives connection errors and ERROR frames which are not related to a receipt
+	OnError func(err error)
+	//OnReconnect is called when the connection is restored, attempt is the number of attempts it took
+	OnReconnect func(attempt int)
+	//OnHeartbeatTimeout is called when the server was silent for too long, the connection is closed afterwards
+	OnHeartbeatTimeout func(silence time.Duration)
+}
+
+//WithHooks register lifecycle hooks
+func WithHooks(hooks Hooks) ClientOption {
+	return func(client *Client) {
+		client.hooks = hooks
+		client.events = make(chan func(), DefaultEventBuffer)
+	}
+}
+
+//State returns the current state of the connection
+func (client *Client) State() State {
+	return State(client.state.Load())
+}
+
+func (client *Client) setState(state State) {
+	client.stateMutex.Lock()
+	previous := State(client.state.Swap(int32(state)))
+	client.signalState(state)
+	client.stateMutex.Unlock()
+
+	if previous != state {
+		client.logger.Debug("connection state changed", slog.String("from", previous.String()), slog.String("to", state.String()))
+		if state == StateClosed {
+			client.removeSubscriptions()
+		}
+	}
+}
+
+//changeState set the state only if it is still the expected one, it returns false otherwise
+func (client *Client) changeState(expected, state State) bool {
+	client.stateMutex.Lock()
+	if !client.state.CompareAndSwap(int32(expected), int32(state)) {
+		client.stateMutex.Unlock()
+		return false
+	}
+	client.signalState(state)
+	client.stateMutex.Unlock()
+
+	if expected != state {
+		client.logger.Debug("connection state changed", slog.String("from", expected.String()), slog.String("to", state.String()))
+		if state == StateClosed {
+			client.removeSubscriptions()
+		}
+	}
+	return true
+}
+
+//signalState wake up waiters of the state, it is called with stateMutex held
+func (client *Client) signalState(state State) {
+	if state == StateConnected && client.connectedSignal != nil {
+		close(client.connectedSignal)
+		client.connectedSignal = nil
+	}
+	if state == StateClosed && client.stop != nil {
+		close(client.stop)
+		client.stop = nil
+	}
+}
+
+//startBackground start goroutines which live until the state becomes StateClosed
+func (client *Client) startBackground() {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	if client.stop != nil {
+		return
+	}
+	client.stop = make(chan struct{})
+	if client.events != nil {
+		previous := client.hooksDone
+		client.hooksDone = make(chan struct{})
+		go client.runHooks(client.stop, previous, client.hooksDone)
+	}
+	if client.scheduler != nil {
+		go client.scheduler.run(client.stop)
+	}
+	if client.dispatcher != nil {
+		client.dispatcher.start(client.stop)
+	}
+}
+
+//awaitConnected wait until the state is StateConnected, it returns false if timeout passes first
+func (client *Client) awaitConnected(timeout time.Duration) bool {
+	client.stateMutex.Lock()
+	if client.State() == StateConnected {
+		client.stateMutex.Unlock()
+		return true
+	}
+	if client.connectedSignal == nil {
+		client.connectedSignal = make(chan struct{})
+	}
+	signal := client.connectedSignal
+	client.stateMutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-signal:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//runHooks call hooks of queued events until stop is closed, events queued before then are handled as well.
+//It starts when the hooks goroutine of the previous connection is done, so hooks never run concurrently.
+func (client *Client) runHooks(stop, previous, done chan struct{}) {
+	defer close(done)
+	if previous != nil {
+		<-previous
+	}
+
+	for {
+		select {
+		case event := <-client.events:
+			event()
+		case <-stop:
+			for {
+				select {
+				case event := <-client.events:
+					event()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//emit queue the event for hooks without blocking the caller
+func (client *Client) emit(event func()) {
+	if client.events == nil {
+		return
+	}
+
+	select {
+	case client.events <- event:
+	default:
+		client.logger.Warn("lifecycle event dropped, hooks are too slow")
+	}
+}
+
+func (client *Client) emitConnected() {
+	if client.hooks.OnConnected != nil {
+		client.emit(client.hooks.OnConnected)
+	}
+}
+
+func (client *Client) emitDisconnected(err error) {
+	if client.hooks.OnDisconnected != nil {
+		client.emit(func() { client.hooks.OnDisconnected(err) })
+	}
+}
+
+func (client *Client) emitReconnect(attempt int) {
+	if client.hooks.OnReconnect != nil {
+		client.emit(func() { client.hooks.OnReconnect(attempt) })
+	}
+}
+
+func (client *Client) emitHeartbeatTimeout(silence time.Duration) {
+	if client.hooks.OnHeartbeatTimeout != nil {
+		client.emit(func() { client.hooks.OnHeartbeatTimeout(silence) })
+	}
+}
+
+//reportError pass the error to OnError and Client.Errors without blocking the caller
+func (client *Client) reportError(err error) {
+	if client.hooks.OnError != nil {
+		client.emit(func() { client.hooks.OnError(err) })
+	}
+
+	select {
+	case client.Errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,68 @@
+package gostomp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestHooksGoroutineStopsWhenClosed(t *testing.T) {
+	disconnected := make(chan error, 1)
+	client, err := NewClient("tcp://localhost:61613",
+		WithHooks(Hooks{OnDisconnected: func(err error) { disconnected <- err }}),
+		WithLogHandler(slog.NewTextHandler(io.Discard, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.startBackground()
+	done := client.hooksDone
+	client.setConn(&recordingConn{})
+	client.setState(StateConnected)
+	client.closed(errors.New("gone"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hooks goroutine does not stop")
+	}
+	select {
+	case err := <-disconnected:
+		if err == nil || err.Error() != "gone" {
+			t.Fatalf("unexpected reason %v", err)
+		}
+	default:
+		t.Fatal("event queued before the client was closed is dropped")
+	}
+}
+
+func TestChangeStateKeepsNewerState(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.setState(StateReconnecting)
+	client.setState(StateDisconnecting)
+	if client.changeState(StateReconnecting, StateConnected) {
+		t.Fatal("reconnect overrides Disconnect")
+	}
+	if state := client.State(); state != StateDisconnecting {
+		t.Fatalf("unexpected state %s", state)
+	}
+}
+
+func TestClosedWithoutConnection(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.closed(nil)
+	if state := client.State(); state != StateClosed {
+		t.Fatalf("unexpected state %s", state)
+	}
+}
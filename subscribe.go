@@ -1,9 +1,11 @@
 package gostomp
 
 import (
+	"errors"
 	"github.com/google/uuid"
 	"github.com/msidorenko/gostomp/frame"
 	"github.com/msidorenko/gostomp/message"
+	"time"
 )
 
 const ACK_AUTO = "auto"
@@ -12,8 +14,6 @@ const ACK_CLIENT_INDIVIDUAL = "client-individual"
 
 type SubscriptionCallback func(msg *message.Message)
 
-var subscriptions []*Subscription
-
 type Subscription struct {
 	id string
 	//The valid values for the ack header are auto, client, or client-individual.
@@ -21,36 +21,284 @@ type Subscription struct {
 	Ack         string
 	Destination string
 	Callback    SubscriptionCallback
+	//Name labels metrics of the subscription. If empty, the id is used, which is random unless Durable is set,
+	//so set it when subscribing repeatedly, otherwise every Subscribe makes new series.
+	Name string
+	//Middleware wraps Callback of this subscription only, see WithConsumeMiddleware
+	Middleware []ConsumeMiddleware
+	//Durable is the name of a durable topic subscription which keeps messages while the client is disconnected.
+	//It is used as the subscription id. ActiveMQ and Artemis also require WithClientID.
+	Durable string
+
+	//Headers are added to the SUBSCRIBE frame as is, e.g. x-queue-name for RabbitMQ.
+	//They cannot override destination, id and ack.
+	Headers map[string]string
+	//Selector is a JMS message selector, e.g. "type = 'order' AND amount > 100"
+	Selector string
+	//Prefetch is the number of messages the broker sends without waiting for acknowledgement, 0 keeps the broker default.
+	//Artemis counts its consumer window in bytes instead.
+	Prefetch int
+	//Exclusive asks the broker to deliver to this consumer only while it is connected
+	Exclusive bool
+	//Priority of the consumer, brokers prefer consumers with higher priority, 0 keeps the broker default
+	Priority int
+
+	//Receipt makes Subscribe wait until the broker confirms the subscription with RECEIPT
+	//or rejects it with ERROR, see WithReceiptTimeout
+	Receipt bool
+	//ready is closed when the subscription is active or Subscribe failed, err is set before then
+	ready chan struct{}
+	err   error
+
+	//AckBatchSize makes Client.Ack of ACK_CLIENT subscription send one cumulative ACK per AckBatchSize messages
+	AckBatchSize int
+	//AckBatchInterval makes ACK_CLIENT subscription send cumulative ACK of processed messages periodically
+	AckBatchInterval time.Duration
+	//tracker keeps unacknowledged deliveries of client ack modes
+	tracker *ackTracker
+
+	//MaxInFlight limits the number of messages handed to Callback which have not returned yet, 0 is unlimited.
+	//In client ack modes a message takes its slot until it is acknowledged, AckBatchSize must not exceed it.
+	MaxInFlight int
+	//FlowControl selects what happens when MaxInFlight is reached: FLOW_PAUSE (default) or FLOW_RESUBSCRIBE
+	FlowControl string
+	window      *flowWindow
+
+	//Weight is the share of workers of WithFairDispatch relative to other subscriptions, 0 is the same as 1
+	Weight int
+
+	//GroupHeader routes messages with the same value of the header, e.g. message.GroupId, to the same worker,
+	//so they are handled one by one in order while different groups are handled in parallel.
+	//Grouped messages bypass WithFairDispatch.
+	GroupHeader string
+	//GroupKey extracts the group key instead of GroupHeader
+	GroupKey GroupKeyFunc
+	//GroupWorkers is the number of workers of grouped messages, DefaultGroupWorkers if zero
+	GroupWorkers int
+	groups       *groupRouter
+
+	//handler is Callback wrapped with client and subscription middleware
+	handler SubscriptionCallback
 }
 
-func addSubscriptions(subscription *Subscription) {
-	subscriptions = append(subscriptions, subscription)
+func (client *Client) addSubscriptions(subscription *Subscription) {
+	client.subscriptionsMutex.Lock()
+	defer client.subscriptionsMutex.Unlock()
+
+	client.subscriptions = append(client.subscriptions, subscription)
 }
 
-func removeSubscription(id string) {
+func (client *Client) removeSubscription(id string) {
+	client.subscriptionsMutex.Lock()
+	defer client.subscriptionsMutex.Unlock()
 
+	subscriptions := client.subscriptions
 	for i, subscription := range subscriptions {
 		if subscription.id == id {
+			if subscription.tracker != nil {
+				close(subscription.tracker.stop)
+			}
+			if subscription.window != nil {
+				close(subscription.window.stop)
+			}
+			if subscription.groups != nil {
+				//the reader may wait for a group worker whose callback needs the subscriptions lock
+				go subscription.groups.close()
+			}
 			subscriptions[i] = subscriptions[len(subscriptions)-1] // Copy last element to index i.
 			subscriptions[len(subscriptions)-1] = nil              // Erase last element (write zero value).
 			subscriptions = subscriptions[:len(subscriptions)-1]   // Truncate slice.
 			break
 		}
 	}
+	client.subscriptions = subscriptions
+}
+
+//removeSubscriptions remove all subscriptions when the client is closed, so their group workers and timers stop.
+//Subscriptions are not restored by Connect, Subscribe them again.
+func (client *Client) removeSubscriptions() {
+	for _, subscription := range client.subscriptionsSnapshot() {
+		client.removeSubscription(subscription.GetID())
+	}
+}
+
+func (client *Client) subscriptionByID(id string) *Subscription {
+	client.subscriptionsMutex.RLock()
+	defer client.subscriptionsMutex.RUnlock()
+
+	for _, subscription := range client.subscriptions {
+		if subscription.id == id {
+			return subscription
+		}
+	}
+	return nil
+}
+
+//subscribeFrame build SUBSCRIBE frame of the subscription, the id must be assigned already
+func (client *Client) subscribeFrame(subscription *Subscription) (*frame.Frame, error) {
+	frm := frame.NewFrame(frame.SUBSCRIBE, []byte(""))
+
+	err := client.subscribeHeaders(subscription, frm.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	frm.Headers[message.Destination] = client.dialect.SubscribeDestination(subscription.Destination, frm.Headers)
+	frm.Headers[message.Id] = subscription.GetID()
+
+	if subscription.Ack == "" {
+		frm.Headers[message.Ack] = ACK_AUTO
+	} else {
+		frm.Headers[message.Ack] = subscription.Ack
+	}
+	return frm, nil
+}
+
+//subscribeHeaders add optional headers of the subscription to SUBSCRIBE headers, validated by the dialect
+func (client *Client) subscribeHeaders(subscription *Subscription, headers map[string]string) error {
+	for key, value := range subscription.Headers {
+		headers[key] = value
+	}
+
+	if subscription.Durable != "" {
+		err := client.dialect.SetDurable(headers, subscription.Durable)
+		if err != nil {
+			return err
+		}
+	}
+	if subscription.Selector != "" {
+		err := client.dialect.SetSelector(headers, subscription.Selector)
+		if err != nil {
+			return err
+		}
+	}
+	if subscription.Prefetch != 0 {
+		err := client.dialect.SetPrefetch(headers, subscription.Prefetch)
+		if err != nil {
+			return err
+		}
+	}
+	if subscription.Exclusive {
+		err := client.dialect.SetExclusive(headers)
+		if err != nil {
+			return err
+		}
+	}
+	if subscription.Priority != 0 {
+		err := client.dialect.SetConsumerPriority(headers, subscription.Priority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func transferFrameToSubscriptions(frm *frame.Frame) {
+func (client *Client) transferFrameToSubscriptions(frm *frame.Frame) {
+	//the lock is not held while dispatching, flow control may block here until a slot of the window is free
+	subscription := client.subscriptionByID(frm.Headers[message.Subscription])
+	if subscription == nil {
+		return
+	}
 
-	for _, subscription := range subscriptions {
-		if subscription.id == frm.Headers["subscription"] {
-			go subscription.Callback(message.NewFromFrame(frm))
+	client.metrics.MessageReceived(subscription.Destination, subscription.metricsName())
+	if !client.startHandler(subscription) {
+		//Shutdown does not wait for new callbacks, the broker redelivers unacknowledged messages
+		return
+	}
+	if !client.acquireWindow(subscription) {
+		client.handlerDone(subscription)
+		return
+	}
+	if subscription.tracker != nil {
+		subscription.tracker.delivered(frm.Headers[message.Ack], frm.Headers[message.MessageId])
+	}
+	client.metrics.DispatchInFlight(1)
+	handle := func() {
+		defer client.handlerDone(subscription)
+		if subscription.tracker == nil {
+			//in client ack modes the slot is freed by ACK or NACK
+			defer client.releaseWindow(subscription, 1)
+		}
+		defer client.metrics.DispatchInFlight(-1)
+
+		msg := message.NewFromFrame(frm)
+		span := client.startConsumerSpan(msg, subscription)
+		if span != nil {
+			defer span.End()
 		}
+		subscription.handler(msg)
+	}
+
+	switch {
+	case subscription.groups != nil:
+		client.route(subscription.groups, subscription.groupKey(frm), handle)
+	case client.dispatcher != nil:
+		client.dispatcher.dispatch(subscription, frm.Headers, handle)
+	default:
+		go handle()
 	}
 }
 
+//startHandler count a new callback for Shutdown, it returns false once Shutdown waits for callbacks
+//of the subscription, callbacks of client ack modes are stopped first
+func (client *Client) startHandler(subscription *Subscription) bool {
+	client.handlersMutex.Lock()
+	defer client.handlersMutex.Unlock()
+
+	if client.handlersStopped || (subscription.tracker != nil && client.ackHandlersStopped) {
+		return false
+	}
+	client.handlers.Add(1)
+	if subscription.tracker != nil {
+		client.ackHandlers.Add(1)
+	}
+	return true
+}
+
+//handlerDone mark a callback counted by startHandler as returned
+func (client *Client) handlerDone(subscription *Subscription) {
+	if subscription.tracker != nil {
+		client.ackHandlers.Done()
+	}
+	client.handlers.Done()
+}
+
+//metricsName returns the subscription label of metrics
+func (subs *Subscription) metricsName() string {
+	if subs.Name != "" {
+		return subs.Name
+	}
+	return subs.id
+}
+
 func (subs *Subscription) GenerateID() {
 	subs.id = uuid.New().String()
 }
 func (subs *Subscription) GetID() string {
 	return subs.id
 }
+
+//Ready returns a channel which is closed when the subscription is active:
+//after SUBSCRIBE is sent or, if Receipt is set, after the broker confirmed it.
+//It is closed as well when Subscribe fails, check Err then.
+//It returns nil before Subscribe is called.
+func (subs *Subscription) Ready() <-chan struct{} {
+	return subs.ready
+}
+
+//fail wake up waiters of Ready with the reason Subscribe failed
+func (subs *Subscription) fail(err error) error {
+	subs.err = errors.New("Cannot subscribe to " + subs.Destination + ". Reason: " + err.Error())
+	close(subs.ready)
+	return subs.err
+}
+
+//Err returns the reason Subscribe failed once Ready is closed, nil if the subscription is active
+func (subs *Subscription) Err() error {
+	select {
+	case <-subs.ready:
+		return subs.err
+	default:
+		return nil
+	}
+}
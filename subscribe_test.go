@@ -0,0 +1,212 @@
+package gostomp
+
+import (
+	"errors"
+	"github.com/msidorenko/gostomp/frame"
+	"github.com/msidorenko/gostomp/message"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+//awaitRouterClosed fail the test unless workers of the router are stopped in time
+func awaitRouterClosed(t *testing.T, router *groupRouter) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		router.mutex.RLock()
+		closed := router.closed
+		router.mutex.RUnlock()
+		if closed {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("group workers are not stopped")
+}
+
+func TestDisconnectRemovesSubscriptions(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		GroupHeader: message.GroupId,
+		Callback:    func(msg *message.Message) {},
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- client.Disconnect()
+	}()
+	headers := broker.expect(frame.DISCONNECT)
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+	if err := <-disconnected; err != nil {
+		t.Fatal(err)
+	}
+
+	if client.subscriptionByID(subscription.GetID()) != nil {
+		t.Fatal("subscription is kept after Disconnect")
+	}
+	awaitRouterClosed(t, subscription.groups)
+}
+
+func TestLostConnectionRemovesSubscriptions(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	subscription := &Subscription{
+		Destination: "/queue/orders",
+		GroupHeader: message.GroupId,
+		Callback:    func(msg *message.Message) {},
+	}
+	err := client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+
+	//without WithReconnect the client is closed
+	broker.conn.Close()
+	awaitRouterClosed(t, subscription.groups)
+	if client.subscriptionByID(subscription.GetID()) != nil {
+		t.Fatal("subscription is kept after the connection is lost")
+	}
+}
+
+func TestDurableSubscription(t *testing.T) {
+	client, err := NewClient("tcp://localhost:61613?dialect=activemq", WithLogHandler(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.setConn(&recordingConn{})
+	client.setState(StateConnected)
+	broker := startPipe(t, client)
+
+	subscription := &Subscription{
+		Destination: "/topic/prices",
+		Durable:     "billing",
+		Callback:    func(msg *message.Message) {},
+	}
+	err = client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := broker.expect(frame.SUBSCRIBE)
+	if subscription.GetID() != "billing" || headers[message.Id] != "billing" || headers["activemq.subscriptionName"] != "billing" {
+		t.Fatalf("unexpected id %s of durable subscription, headers %v", subscription.GetID(), headers)
+	}
+
+	//Unsubscribe detaches, the broker keeps the durable subscription
+	client.Unsubscribe(subscription.GetID())
+	headers = broker.expect(frame.UNSUBSCRIBE)
+	if _, ok := headers["activemq.subscriptionName"]; ok || headers[message.Id] != "billing" {
+		t.Fatalf("UNSUBSCRIBE removes the durable subscription: %v", headers)
+	}
+	if client.subscriptionByID("billing") != nil {
+		t.Fatal("subscription is kept after Unsubscribe")
+	}
+
+	err = client.Subscribe(subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect(frame.SUBSCRIBE)
+	err = client.RemoveDurableSubscription("billing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers = broker.expect(frame.UNSUBSCRIBE)
+	if headers[message.Id] != "billing" || headers["activemq.subscriptionName"] != "billing" {
+		t.Fatalf("UNSUBSCRIBE does not remove the durable subscription: %v", headers)
+	}
+	if client.subscriptionByID("billing") != nil {
+		t.Fatal("subscription is kept after RemoveDurableSubscription")
+	}
+
+	client.dialect = Generic
+	if err := client.RemoveDurableSubscription("billing"); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Fatalf("expected ErrUnsupportedFeature, got %v", err)
+	}
+}
+
+func TestSubscriptionReady(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	subscription := &Subscription{Destination: "/queue/orders", Receipt: true, Callback: func(msg *message.Message) {}}
+	if subscription.Ready() != nil || subscription.Err() != nil {
+		t.Fatal("subscription is ready before Subscribe")
+	}
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- client.Subscribe(subscription)
+	}()
+	headers := broker.expect(frame.SUBSCRIBE)
+
+	select {
+	case <-subscription.Ready():
+		t.Fatal("Ready is closed before the receipt")
+	case <-time.After(20 * time.Millisecond):
+	}
+	broker.send(frame.RECEIPT, map[string]string{message.ReceiptId: headers[message.Receipt]})
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+	<-subscription.Ready()
+	if subscription.Err() != nil {
+		t.Fatalf("unexpected error %v", subscription.Err())
+	}
+}
+
+func TestSubscriptionErr(t *testing.T) {
+	client := newConnectedClient(t, &recordingConn{})
+	broker := startPipe(t, client)
+
+	rejected := &Subscription{Destination: "/queue/secret", Receipt: true, Callback: func(msg *message.Message) {}}
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- client.Subscribe(rejected)
+	}()
+	headers := broker.expect(frame.SUBSCRIBE)
+	broker.send(frame.ERROR, map[string]string{message.ReceiptId: headers[message.Receipt], message.Message_: "access denied"})
+
+	err := <-subscribed
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("expected the ERROR of the broker, got %v", err)
+	}
+	select {
+	case <-rejected.Ready():
+	default:
+		t.Fatal("Ready is not closed when Subscribe fails")
+	}
+	if rejected.Err() != err {
+		t.Fatalf("Err returns %v instead of the error of Subscribe %v", rejected.Err(), err)
+	}
+	if client.subscriptionByID(rejected.GetID()) != nil {
+		t.Fatal("rejected subscription is kept")
+	}
+
+	//the subscription is not sent at all, generic STOMP has no durable subscriptions
+	unsupported := &Subscription{Destination: "/topic/prices", Durable: "billing", Callback: func(msg *message.Message) {}}
+	err = client.Subscribe(unsupported)
+	if err == nil {
+		t.Fatal("durable subscription is accepted by generic STOMP")
+	}
+	select {
+	case <-unsupported.Ready():
+	default:
+		t.Fatal("Ready is not closed when Subscribe fails")
+	}
+	if unsupported.Err() != err {
+		t.Fatalf("Err returns %v instead of the error of Subscribe %v", unsupported.Err(), err)
+	}
+}
@@ -0,0 +1,197 @@
+package gostomp
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/msidorenko/gostomp/message"
+	"strings"
+)
+
+const (
+	TraceParent = "traceparent"
+	TraceState  = "tracestate"
+)
+
+//Span attributes set on producer and consumer spans
+const (
+	AttrMessagingSystem       = "messaging.system"
+	AttrMessagingDestination  = "messaging.destination.name"
+	AttrMessagingMessageId    = "messaging.message.id"
+	AttrMessagingSubscription = "messaging.stomp.subscription"
+)
+
+//TextMapCarrier is the storage of propagated fields, usually message.HeaderCarrier
+type TextMapCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+//TextMapPropagator injects trace context into outgoing message headers and extracts it from received ones.
+//The method set mirrors OpenTelemetry propagation.TextMapPropagator, see package otelstomp for an adapter.
+type TextMapPropagator interface {
+	Inject(ctx context.Context, carrier TextMapCarrier)
+	Extract(ctx context.Context, carrier TextMapCarrier) context.Context
+	Fields() []string
+}
+
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota
+	SpanKindConsumer
+)
+
+//Tracer starts spans around sending and consuming messages
+type Tracer interface {
+	Start(ctx context.Context, name string, kind SpanKind, attrs map[string]string) (context.Context, Span)
+}
+
+type Span interface {
+	RecordError(err error)
+	End()
+}
+
+//WithTracing enable trace context propagation through message headers.
+//If propagator is nil the W3C TraceContext propagator is used, if tracer is nil no spans are started.
+func WithTracing(propagator TextMapPropagator, tracer Tracer) ClientOption {
+	return func(client *Client) {
+		if propagator == nil {
+			propagator = TraceContext{}
+		}
+		client.propagator = propagator
+		client.tracer = tracer
+	}
+}
+
+//startProducerSpan start a span for msg and inject its context into the message headers
+func (client *Client) startProducerSpan(msg *message.Message) Span {
+	if client.propagator == nil {
+		return nil
+	}
+
+	ctx := msg.Context()
+	var span Span
+	if client.tracer != nil {
+		ctx, span = client.tracer.Start(ctx, "send "+msg.GetDestination(), SpanKindProducer, map[string]string{
+			AttrMessagingSystem:      "stomp",
+			AttrMessagingDestination: msg.GetDestination(),
+			AttrMessagingMessageId:   msg.GetID(),
+		})
+		msg.SetContext(ctx)
+	}
+
+	client.propagator.Inject(ctx, message.HeaderCarrier(msg.GetHeaders()))
+	return span
+}
+
+//startConsumerSpan extract the trace context from msg headers and start a span for the subscription callback
+func (client *Client) startConsumerSpan(msg *message.Message, subscription *Subscription) Span {
+	if client.propagator == nil {
+		return nil
+	}
+
+	ctx := client.propagator.Extract(msg.Context(), message.HeaderCarrier(msg.GetHeaders()))
+	var span Span
+	if client.tracer != nil {
+		ctx, span = client.tracer.Start(ctx, "process "+subscription.Destination, SpanKindConsumer, map[string]string{
+			AttrMessagingSystem:       "stomp",
+			AttrMessagingDestination:  msg.GetDestination(),
+			AttrMessagingMessageId:    msg.GetID(),
+			AttrMessagingSubscription: subscription.GetID(),
+		})
+	}
+	msg.SetContext(ctx)
+	return span
+}
+
+//SpanContext identifies a span in W3C Trace Context format
+type SpanContext struct {
+	//TraceID is 32 lowercase hex characters
+	TraceID string
+	//SpanID is 16 lowercase hex characters
+	SpanID     string
+	Sampled    bool
+	TraceState string
+}
+
+//IsValid reports whether trace and span ids are well-formed and not all zeros
+func (sc SpanContext) IsValid() bool {
+	return isTraceHex(sc.TraceID, 32) && isTraceHex(sc.SpanID, 16)
+}
+
+type spanContextKey struct{}
+
+//ContextWithSpanContext returns a copy of ctx carrying sc, TraceContext injects it into sent messages
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+//SpanContextFromContext returns the span context stored in ctx, for received messages use msg.Context()
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+//TraceContext propagates SpanContext using W3C traceparent and tracestate headers
+type TraceContext struct{}
+
+func (TraceContext) Inject(ctx context.Context, carrier TextMapCarrier) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.IsValid() {
+		return
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	carrier.Set(TraceParent, "00-"+sc.TraceID+"-"+sc.SpanID+"-"+flags)
+	if sc.TraceState != "" {
+		carrier.Set(TraceState, sc.TraceState)
+	}
+}
+
+func (TraceContext) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	parts := strings.Split(carrier.Get(TraceParent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return ctx
+	}
+	//version 00 has exactly four fields, future versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return ctx
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+
+	sc := SpanContext{
+		TraceID:    parts[1],
+		SpanID:     parts[2],
+		Sampled:    flags[0]&1 == 1,
+		TraceState: carrier.Get(TraceState),
+	}
+	if !sc.IsValid() {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+func (TraceContext) Fields() []string {
+	return []string{TraceParent, TraceState}
+}
+
+//isTraceHex check that s is lowercase hex of given length and not all zeros
+func isTraceHex(s string, length int) bool {
+	if len(s) != length || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
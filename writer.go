@@ -16,15 +16,33 @@ var (
 
 // Writes STOMP frames to an underlying io.Writer
 type Writer struct {
-	writer *bufio.Writer
+	writer  *bufio.Writer
+	counter *countingWriter
 }
 
 // Creates a new Writer object, which writes to an underlying io.Writer.
 func NewWriter(writer io.Writer, bufferSize int) *Writer {
-	return &Writer{writer: bufio.NewWriterSize(writer, bufferSize)}
+	counter := &countingWriter{writer: writer}
+	return &Writer{writer: bufio.NewWriterSize(counter, bufferSize), counter: counter}
 }
 
+// Returns the number of bytes flushed to the underlying io.Writer.
+func (w *Writer) BytesWritten() int64 {
+	return w.counter.written
+}
+
+// Writes the frame and flushes it to the underlying io.Writer.
 func (w *Writer) Write(frm *frame.Frame) error {
+	err := w.WriteBuffered(frm)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Writes the frame into the buffer, it reaches the underlying io.Writer
+// when the buffer is full or Flush is called.
+func (w *Writer) WriteBuffered(frm *frame.Frame) error {
 	_, err := w.writer.Write([]byte(frm.Command))
 	if err != nil {
 		return err
@@ -35,10 +53,8 @@ func (w *Writer) Write(frm *frame.Frame) error {
 		return err
 	}
 
-	//println("TX:", frm.Command)
 	if len(frm.Headers) > 0 {
 		for key, value := range frm.Headers {
-			//println(key + ": " + value)
 			_, err = w.writer.Write(encodeValue(key))
 			if err != nil {
 				return err
@@ -77,10 +93,27 @@ func (w *Writer) Write(frm *frame.Frame) error {
 		return err
 	}
 
-	err = w.writer.Flush()
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
+
+// Flushes buffered frames to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
+
+// Returns the number of bytes written so far including the buffered ones.
+func (w *Writer) bytesQueued() int64 {
+	return w.counter.written + int64(w.writer.Buffered())
+}
+
+// Counts bytes written to an underlying io.Writer
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}